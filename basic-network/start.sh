@@ -9,6 +9,10 @@ set -ev
 
 docker-compose -f docker-compose.yml down
 
+# Build the genesis block and channel transaction with the capabilities in
+# configtx.yaml, using the configtxgen of the tools image the network runs
+docker run --rm -v ${PWD}:/etc/hyperledger/basic-network -w /etc/hyperledger/basic-network -e FABRIC_CFG_PATH=/etc/hyperledger/basic-network hyperledger/fabric-tools:1.4.4 sh -c 'configtxgen -profile OneOrgOrdererGenesis -outputBlock ./config/genesis.block && configtxgen -profile OneOrgChannel -outputCreateChannelTx ./config/channel.tx -channelID mychannel'
+
 docker-compose -f docker-compose.yml up -d ca.example.com orderer.example.com peer0.org1.example.com couchdb
 
 # wait for Hyperledger Fabric to start
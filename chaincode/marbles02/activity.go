@@ -0,0 +1,166 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// ==== User activity ====
+// Every change a user takes part in is also written to the user's activity log, a composite key
+// activity~user~time~txid~kind~subject, so a user's activity reads back sorted by time:
+// marbles minted, received, sent and traded, and open trades opened, amended, cancelled and filled.
+// peer chaincode query -C myc1 -n marbles -c '{"Args":["getUserActivity","alice"]}'
+// peer chaincode query -C myc1 -n marbles -c '{"Args":["getUserActivity","alice","20",""]}'
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// activity kinds
+const (
+	activityMinted         = "minted"
+	activityReceived       = "received"
+	activitySent           = "sent"
+	activityTraded         = "traded" //a marble given or received in a settlement
+	activityTradeOpened    = "tradeOpened"
+	activityTradeAmended   = "tradeAmended"
+	activityTradeCancelled = "tradeCancelled"
+	activityTradeFilled    = "tradeFilled"
+)
+
+type activity struct {
+	ObjectType string       `json:"docType"`
+	User       string       `json:"user"`
+	Kind       string       `json:"kind"`
+	TxID       string       `json:"txId"`
+	Timestamp  int64        `json:"timestamp"`
+	Marble     string       `json:"marble,omitempty"`
+	From       string       `json:"from,omitempty"`
+	To         string       `json:"to,omitempty"`
+	Settlement string       `json:"settlement,omitempty"`
+	Trade      *AnOpenTrade `json:"trade,omitempty"`
+}
+
+// ============================================================
+// recordActivity - add an entry to the activity log of a user, at the transaction time
+// ============================================================
+func recordActivity(stub shim.ChaincodeStubInterface, entry activity) error {
+	timestamp, err := txTimestamp(stub)
+	if err != nil {
+		return err
+	}
+	entry.ObjectType = "activity"
+	entry.TxID = stub.GetTxID()
+	entry.Timestamp = timestamp
+
+	// the subject keeps entries of one transaction apart, e.g. both marbles a user traded in a settlement
+	subject := entry.Marble
+	if entry.Trade != nil {
+		subject = strconv.FormatInt(entry.Trade.Timestamp, 10)
+	}
+	// zero padded so the keys sort by time
+	activityKey, err := stub.CreateCompositeKey("activity", []string{entry.User, fmt.Sprintf("%020d", timestamp), entry.TxID, entry.Kind, subject})
+	if err != nil {
+		return err
+	}
+	entryAsBytes, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(activityKey, entryAsBytes)
+}
+
+// ============================================================
+// recordTransfer - log a marble moving from one owner to another, on both sides
+// ============================================================
+func recordTransfer(stub shim.ChaincodeStubInterface, m *marble, from string) error {
+	sent, received := activitySent, activityReceived
+	if m.Settlement != "" {
+		sent, received = activityTraded, activityTraded
+	}
+	err := recordActivity(stub, activity{User: from, Kind: sent, Marble: m.Name, From: from, To: m.Owner, Settlement: m.Settlement})
+	if err != nil {
+		return err
+	}
+	return recordActivity(stub, activity{User: m.Owner, Kind: received, Marble: m.Name, From: from, To: m.Owner, Settlement: m.Settlement})
+}
+
+// ============================================================
+// recordTradeActivity - log a change of an open trade for the user who opened it
+// ============================================================
+func recordTradeActivity(stub shim.ChaincodeStubInterface, kind string, trade AnOpenTrade, settlementID string) error {
+	return recordActivity(stub, activity{User: trade.User, Kind: kind, Settlement: settlementID, Trade: &trade})
+}
+
+// ============================================================
+// getUserActivity - the activity log of a user, oldest first
+// ============================================================
+func (t *SimpleChaincode) getUserActivity(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0        1       2
+	// "alice", ["10", ["bookmark"]]
+	if len(args) < 1 || len(args) > 3 {
+		return errorWithCode(codeInvalidArgument, "Incorrect number of arguments. Expecting 1 to 3")
+	}
+	user := strings.ToLower(args[0])
+	fmt.Println("- start getUserActivity ", user)
+
+	if len(args) > 1 {
+		pageSize, bookmark, err := parsePageArgs(args[1:])
+		if err != nil {
+			return errorResponse(err)
+		}
+		resultsIterator, responseMetadata, err := stub.GetStateByPartialCompositeKeyWithPagination("activity", []string{user}, pageSize, bookmark)
+		if err != nil {
+			return errorResponse(err)
+		}
+		defer resultsIterator.Close()
+
+		pageAsBytes, err := constructPaginatedResult(resultsIterator, responseMetadata)
+		if err != nil {
+			return errorResponse(err)
+		}
+		return shim.Success(pageAsBytes)
+	}
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey("activity", []string{user})
+	if err != nil {
+		return errorResponse(err)
+	}
+	defer resultsIterator.Close()
+
+	entries := []json.RawMessage{}
+	for resultsIterator.HasNext() {
+		responseRange, err := resultsIterator.Next()
+		if err != nil {
+			return errorResponse(err)
+		}
+		entries = append(entries, json.RawMessage(responseRange.Value))
+	}
+	entriesAsBytes, err := json.Marshal(entries)
+	if err != nil {
+		return errorResponse(err)
+	}
+	fmt.Printf("- end getUserActivity: %d entries\n", len(entries))
+	return shim.Success(entriesAsBytes)
+}
@@ -0,0 +1,285 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// ==== Admin role ====
+// The admin list is set at instantiation (or upgrade) time, one entry per argument:
+// peer chaincode instantiate -C myc1 -n marbles -v 1.0 -c '{"Args":["init","Org1MSP"]}'
+// peer chaincode instantiate -C myc1 -n marbles -v 1.0 -c '{"Args":["init","Org1MSP:role=admin",":marbles.admin=true"]}'
+//
+// An entry is "<mspid>[:<attribute>=<value>]". An empty mspid matches any MSP, so
+// ":marbles.admin=true" grants the role to every enrolled identity carrying that certificate attribute.
+//
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["addAdmin","Org2MSP"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["removeAdmin","Org2MSP"]}'
+// peer chaincode query -C myc1 -n marbles -c '{"Args":["readAdmins"]}'
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+type adminEntry struct {
+	MSPID     string `json:"mspid,omitempty"`     //empty matches any MSP
+	Attribute string `json:"attribute,omitempty"` //certificate attribute the caller must carry, if any
+	Value     string `json:"value,omitempty"`
+}
+
+type adminConfig struct {
+	ObjectType string       `json:"docType"`
+	Admins     []adminEntry `json:"admins"`
+}
+
+var adminConfigStr = "_adminconfig" //name for the key/value that will store the admin list
+
+// adminFunctions are the operational functions that can wipe or move everyone's assets.
+// Invoke refuses them unless the caller holds the admin role.
+var adminFunctions = map[string]bool{
+	"transferMarblesBasedOnColor": true,
+	"swapMarble":                  true,
+	"swapMarbleTri":               true,
+	"matchTrade":                  true,
+	"matchTrade2":                 true,
+	"matchTriTrade":               true,
+	"clearOpenTrades":             true,
+	"defineSchema":                true,
+	"setCustodian":                true,
+	"addAdmin":                    true,
+	"removeAdmin":                 true,
+	"rebuildIndexes":              true,
+	"matchPrivateTrades":          true,
+	"openSealedRound":             true,
+	"closeSealedRound":            true,
+	"mintCredits":                 true,
+	"setFeeSchedule":              true,
+	"setTradeLimits":              true,
+	"setSelfTradePolicy":          true,
+}
+
+// ============================================================
+// parseAdminEntry - parse "<mspid>[:<attribute>=<value>]"
+// ============================================================
+func parseAdminEntry(spec string) (adminEntry, error) {
+	entry := adminEntry{}
+	parts := strings.SplitN(spec, ":", 2)
+	entry.MSPID = parts[0]
+	if len(parts) == 2 {
+		attr := strings.SplitN(parts[1], "=", 2)
+		if len(attr) != 2 || len(attr[0]) <= 0 || len(attr[1]) <= 0 {
+			return entry, newError(codeInvalidArgument, fmt.Sprintf("Invalid admin entry %q, expecting <mspid>[:<attribute>=<value>]", spec))
+		}
+		entry.Attribute = attr[0]
+		entry.Value = attr[1]
+	}
+	if entry.MSPID == "" && entry.Attribute == "" {
+		return entry, newError(codeInvalidArgument, fmt.Sprintf("Invalid admin entry %q, an MSP ID or an attribute is required", spec))
+	}
+	return entry, nil
+}
+
+// ============================================================
+// getAdminConfig - read the admin list from chaincode state
+// ============================================================
+func getAdminConfig(stub shim.ChaincodeStubInterface) (adminConfig, error) {
+	config := adminConfig{ObjectType: "adminConfig"}
+	configAsBytes, err := stub.GetState(adminConfigStr)
+	if err != nil {
+		return config, errors.New("Failed to get admin list: " + err.Error())
+	} else if configAsBytes == nil {
+		return config, nil
+	}
+	err = json.Unmarshal(configAsBytes, &config)
+	if err != nil {
+		return config, errors.New("Failed to decode admin list: " + err.Error())
+	}
+	return config, nil
+}
+
+func putAdminConfig(stub shim.ChaincodeStubInterface, config adminConfig) error {
+	configAsBytes, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(adminConfigStr, configAsBytes)
+}
+
+// ============================================================
+// isAdmin - check the caller's identity against the admin list
+// ============================================================
+func isAdmin(stub shim.ChaincodeStubInterface) (bool, error) {
+	config, err := getAdminConfig(stub)
+	if err != nil {
+		return false, err
+	}
+	if len(config.Admins) == 0 {
+		return false, nil
+	}
+
+	mspid, err := cid.GetMSPID(stub)
+	if err != nil {
+		return false, errors.New("Failed to get caller MSP ID: " + err.Error())
+	}
+	for _, entry := range config.Admins {
+		if entry.MSPID != "" && entry.MSPID != mspid {
+			continue
+		}
+		if entry.Attribute == "" {
+			return true, nil
+		}
+		value, found, err := cid.GetAttributeValue(stub, entry.Attribute)
+		if err != nil {
+			return false, errors.New("Failed to get caller attribute " + entry.Attribute + ": " + err.Error())
+		}
+		if found && value == entry.Value {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ============================================================
+// requireAdmin - return an error unless the caller holds the admin role
+// ============================================================
+func requireAdmin(stub shim.ChaincodeStubInterface, function string) error {
+	admin, err := isAdmin(stub)
+	if err != nil {
+		return err
+	}
+	if !admin {
+		return newError(codeForbidden, function+" requires the admin role")
+	}
+	return nil
+}
+
+// ============================================================
+// initAdmins - store the admin list passed to Init
+// ============================================================
+func initAdmins(stub shim.ChaincodeStubInterface, args []string) error {
+	config := adminConfig{ObjectType: "adminConfig"}
+	for _, arg := range args {
+		if arg == "" { //older scripts instantiate with '{"Args":[""]}'
+			continue
+		}
+		entry, err := parseAdminEntry(arg)
+		if err != nil {
+			return err
+		}
+		config.Admins = append(config.Admins, entry)
+	}
+
+	// an upgrade without arguments keeps the current admin list
+	if len(config.Admins) == 0 {
+		fmt.Println("- no admin given to Init, keeping the current admin list")
+		return nil
+	}
+	return putAdminConfig(stub, config)
+}
+
+// ============================================================
+// addAdmin - grant the admin role to an MSP ID and/or certificate attribute
+// ============================================================
+func (t *SimpleChaincode) addAdmin(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0
+	// "Org2MSP:role=admin"
+	if len(args) != 1 {
+		return errorWithCode(codeInvalidArgument, "Incorrect number of arguments. Expecting 1")
+	}
+
+	entry, err := parseAdminEntry(args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	config, err := getAdminConfig(stub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	for _, existing := range config.Admins {
+		if existing == entry {
+			return errorWithCode(codeAlreadyExists, "This admin already exists: "+args[0])
+		}
+	}
+
+	config.Admins = append(config.Admins, entry)
+	err = putAdminConfig(stub, config)
+	if err != nil {
+		return errorResponse(err)
+	}
+	fmt.Println("- end addAdmin " + args[0])
+	return shim.Success(nil)
+}
+
+// ============================================================
+// removeAdmin - revoke an admin entry, the last one cannot be removed
+// ============================================================
+func (t *SimpleChaincode) removeAdmin(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0
+	// "Org2MSP:role=admin"
+	if len(args) != 1 {
+		return errorWithCode(codeInvalidArgument, "Incorrect number of arguments. Expecting 1")
+	}
+
+	entry, err := parseAdminEntry(args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	config, err := getAdminConfig(stub)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	for i := range config.Admins {
+		if config.Admins[i] == entry {
+			if len(config.Admins) == 1 {
+				return errorWithCode(codeFailedPrecondition, "Cannot remove the last admin")
+			}
+			config.Admins = append(config.Admins[:i], config.Admins[i+1:]...)
+			err = putAdminConfig(stub, config)
+			if err != nil {
+				return errorResponse(err)
+			}
+			fmt.Println("- end removeAdmin " + args[0])
+			return shim.Success(nil)
+		}
+	}
+	return errorWithCode(codeNotFound, "Admin does not exist: "+args[0])
+}
+
+// ============================================================
+// readAdmins - read the admin list
+// ============================================================
+func (t *SimpleChaincode) readAdmins(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	config, err := getAdminConfig(stub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	configAsBytes, err := json.Marshal(config)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return shim.Success(configAsBytes)
+}
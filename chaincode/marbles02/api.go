@@ -0,0 +1,305 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// ==== API v2 ====
+// Every function can also be called as "v2/<function>" with a single JSON document as argument.
+// The document is validated against the fields declared below for the function, then converted
+// to the positional arguments of the v1 function, so both forms behave the same.
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["v2/initMarble","{\"name\":\"marble1\",\"color\":\"blue\",\"size\":35,\"owner\":\"tom\"}"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["v2/openTrade","{\"user\":\"tom\",\"want\":{\"color\":\"red\",\"size\":50},\"willing\":{\"color\":\"blue\",\"size\":35}}"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["v2/swapMarbleTri","{\"first\":{\"owner\":\"tom\",\"color\":\"blue\",\"size\":35},\"second\":{...},\"third\":{...}}"]}'
+// peer chaincode query -C myc1 -n marbles -c '{"Args":["v2/queryMarbles","{\"query\":{\"selector\":{\"owner\":\"tom\"}},\"pageSize\":10}"]}'
+// peer chaincode query -C myc1 -n marbles -c '{"Args":["v2/readOpenTrade"]}'
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const apiV2Prefix = "v2/"
+
+// argument types of a v2 field
+const (
+	argString  = "string"
+	argInteger = "integer"
+	argBoolean = "boolean"
+	argObject  = "object" //passed on as JSON text
+	argArray   = "array"  //passed on as JSON text
+)
+
+// argField declares one field of a v2 document, in the order of the v1 positional arguments
+type argField struct {
+	Path     string //field name, dotted for nested objects e.g. "want.color"
+	Type     string
+	Required bool
+}
+
+func required(path string, argType string) argField {
+	return argField{path, argType, true}
+}
+
+func optional(path string, argType string) argField {
+	return argField{path, argType, false}
+}
+
+var pageFields = []argField{optional("pageSize", argInteger), optional("bookmark", argString)}
+
+func withPage(fields ...argField) []argField {
+	return append(fields, pageFields...)
+}
+
+var v2Functions = map[string][]argField{
+	"initMarble": {required("name", argString), required("color", argString), required("size", argInteger), required("owner", argString),
+		optional("attributes", argObject), optional("custodian", argString)},
+	"transferMarble":              {required("name", argString), required("newOwner", argString)},
+	"transferMarblesBasedOnColor": {required("color", argString), required("newOwner", argString)},
+	"transferMarblesByFilter": {required("newOwner", argString), optional("color", argString), optional("minSize", argInteger),
+		optional("maxSize", argInteger), optional("owner", argString), optional("maxCount", argInteger), optional("dryRun", argBoolean)},
+	"delete":              {required("name", argString)},
+	"readMarble":          {required("name", argString)},
+	"queryMarblesByOwner": withPage(required("owner", argString)),
+	"queryMarbles":        withPage(required("query", argObject)),
+	"getHistoryForMarble": withPage(required("name", argString), optional("from", argString), optional("to", argString)),
+	"getMarblesByRange":   withPage(required("startKey", argString), required("endKey", argString)),
+	"openTrade": {required("user", argString), required("want.color", argString), required("want.size", argInteger),
+		required("willing.color", argString), required("willing.size", argInteger), optional("credits", argInteger)},
+	"initOpenTrade": {required("user", argString), required("want.color", argString), required("want.size", argInteger),
+		required("willing.color", argString), required("willing.size", argInteger), optional("credits", argInteger)},
+	"getOpenTradesByRange": withPage(required("startKey", argString), required("endKey", argString)),
+	"readOpenTrade":        {},
+	"removeOpenTrade":      {required("timestamp", argInteger)},
+	"swapMarble": {required("first.owner", argString), required("first.color", argString), required("first.size", argInteger),
+		required("second.owner", argString), required("second.color", argString), required("second.size", argInteger)},
+	"swapMarbleTri": {required("first.owner", argString), required("first.color", argString), required("first.size", argInteger),
+		required("second.owner", argString), required("second.color", argString), required("second.size", argInteger),
+		required("third.owner", argString), required("third.color", argString), required("third.size", argInteger)},
+	"matchTrade":      {},
+	"matchTrade2":     {},
+	"matchTriTrade":   {},
+	"clearOpenTrades": {},
+	"addAdmin":        {required("entry", argString)},
+	"removeAdmin":     {required("entry", argString)},
+	"readAdmins":      {},
+	"registerUser":    {required("handle", argString), optional("mspid", argString), optional("identity", argString)},
+	"readUser":        {required("handle", argString)},
+	"listUsers":       {},
+	"defineSchema":    {required("assetClass", argString), required("fields", argArray)},
+	"readSchema":      {required("assetClass", argString), optional("version", argInteger)},
+	"bindMarble": {required("name", argString), optional("serialNumber", argString), optional("tagHash", argString),
+		optional("photoHash", argString)},
+	"readMarbleByTag": {required("tagHash", argString)},
+	"setCustodian":    {required("handle", argString), required("custodian", argBoolean)},
+	"approveMint": {required("name", argString), required("custodian", argString), optional("note", argString),
+		optional("serialNumber", argString), optional("tagHash", argString), optional("photoHash", argString)},
+	"rejectMint":           {required("name", argString), required("custodian", argString), required("reason", argString)},
+	"readMintRequest":      {required("name", argString)},
+	"requestRedemption":    {required("name", argString)},
+	"cancelRedemption":     {required("name", argString)},
+	"confirmRedemption":    {required("name", argString), required("custodian", argString)},
+	"updateMarble":         {required("name", argString), required("changes", argObject), required("reason", argString)},
+	"verifyIndexes":        {},
+	"rebuildIndexes":       {optional("batchSize", argInteger), optional("bookmark", argString)},
+	"initMarbles":          {required("entries", argArray)},
+	"transferMarbles":      {required("entries", argArray)},
+	"readSettlement":       {required("id", argString)},
+	"getOwnershipTimeline": {required("name", argString)},
+	"getUserActivity":      withPage(required("user", argString)),
+	"getProvenance":        {required("name", argString)},
+	"openPrivateTrade":     {}, //the trade is passed in the transient map
+	"readPrivateTrade":     {required("id", argString)},
+	"removePrivateTrade":   {required("id", argString)},
+	"matchPrivateTrades":   {},
+	"openSealedRound":      {required("commitSeconds", argInteger), required("revealSeconds", argInteger)},
+	"readSealedRound":      {},
+	"commitTradeIntent":    {required("user", argString), required("hash", argString)},
+	"revealTradeIntent": {required("id", argString), required("want.color", argString), required("want.size", argInteger),
+		required("willing.color", argString), required("willing.size", argInteger), required("salt", argString)},
+	"closeSealedRound": {},
+	"amendOpenTrade": {required("timestamp", argInteger), required("want.color", argString), required("want.size", argInteger),
+		required("willing.color", argString), required("willing.size", argInteger), optional("credits", argInteger)},
+	"mintCredits":         {required("user", argString), required("amount", argInteger)},
+	"transferCredits":     {required("from", argString), required("to", argString), required("amount", argInteger)},
+	"readCreditBalance":   {required("user", argString)},
+	"setFeeSchedule":      {required("perLeg", argInteger), required("perCycle", argInteger), required("operator", argString)},
+	"readFeeSchedule":     {optional("version", argInteger)},
+	"depositFees":         {required("user", argString), required("amount", argInteger)},
+	"readFeeBalance":      {required("user", argString)},
+	"getReputation":       {required("user", argString)},
+	"setTradeLimits":      {required("maxOpenTrades", argInteger), required("duplicates", argString)},
+	"readTradeLimits":     {},
+	"setSelfTradePolicy":  {required("policy", argString)},
+	"readSelfTradePolicy": {},
+}
+
+// ============================================================
+// convertV2Call - validate the JSON document of a v2 call and convert it to the v1 function and arguments
+// ============================================================
+func convertV2Call(function string, args []string) (string, []string, error) {
+	name := strings.TrimPrefix(function, apiV2Prefix)
+	fields, ok := v2Functions[name]
+	if !ok {
+		return "", nil, newError(codeInvalidArgument, "Received unknown function invocation: "+function)
+	}
+	if len(args) > 1 {
+		return "", nil, newError(codeInvalidArgument, "Incorrect number of arguments. Expecting one JSON document")
+	}
+
+	doc := map[string]interface{}{}
+	if len(args) == 1 && len(args[0]) > 0 {
+		decoder := json.NewDecoder(bytes.NewReader([]byte(args[0])))
+		decoder.UseNumber() //keep integers exact
+		err := decoder.Decode(&doc)
+		if err != nil {
+			return "", nil, newError(codeInvalidArgument, "Argument must be a JSON object: "+err.Error())
+		}
+		if decoder.More() {
+			return "", nil, newError(codeInvalidArgument, "Argument must be a single JSON object")
+		}
+	}
+	positional, err := documentArgs(doc, fields)
+	if err != nil {
+		return "", nil, err
+	}
+	fmt.Printf("- convertV2Call %s: %q\n", name, positional)
+	return name, positional, nil
+}
+
+// ============================================================
+// documentArgs - validate a decoded document against the declared fields and return the positional arguments
+// ============================================================
+func documentArgs(doc map[string]interface{}, fields []argField) ([]string, error) {
+	err := checkUnknownFields(doc, "", fields)
+	if err != nil {
+		return nil, err
+	}
+
+	positional := make([]string, len(fields))
+	for i, field := range fields {
+		value, found := lookupField(doc, field.Path)
+		if !found || value == nil {
+			if field.Required {
+				return nil, newError(codeInvalidArgument, fmt.Sprintf("Field %q is required", field.Path))
+			}
+			continue
+		}
+		positional[i], err = formatArgument(field, value)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// optional arguments left out at the end are dropped, as a v1 caller would
+	for len(positional) > 0 && positional[len(positional)-1] == "" && !fields[len(positional)-1].Required {
+		positional = positional[:len(positional)-1]
+	}
+	return positional, nil
+}
+
+// ============================================================
+// checkUnknownFields - reject fields that are not declared, so a misspelled optional field is not silently ignored
+// ============================================================
+func checkUnknownFields(doc map[string]interface{}, prefix string, fields []argField) error {
+	for key, value := range doc {
+		path := prefix + key
+		leaf, parent := false, false
+		for _, field := range fields {
+			if field.Path == path {
+				leaf = true
+			} else if strings.HasPrefix(field.Path, path+".") {
+				parent = true
+			}
+		}
+		if leaf {
+			continue
+		}
+		if !parent {
+			return newError(codeInvalidArgument, fmt.Sprintf("Field %q is not defined for this function", path))
+		}
+		nested, ok := value.(map[string]interface{})
+		if !ok {
+			return newError(codeInvalidArgument, fmt.Sprintf("Field %q must be an object", path))
+		}
+		err := checkUnknownFields(nested, path+".", fields)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ============================================================
+// lookupField - find the value at a dotted path
+// ============================================================
+func lookupField(doc map[string]interface{}, path string) (interface{}, bool) {
+	var value interface{} = doc
+	for _, key := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		value, ok = object[key]
+		if !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// ============================================================
+// formatArgument - check the type of a field value and format it as a v1 argument
+// ============================================================
+func formatArgument(field argField, value interface{}) (string, error) {
+	switch field.Type {
+	case argString:
+		if s, ok := value.(string); ok {
+			return s, nil
+		}
+		return "", newError(codeInvalidArgument, fmt.Sprintf("Field %q must be a string", field.Path))
+	case argInteger:
+		if n, ok := value.(json.Number); ok {
+			i, err := strconv.ParseInt(n.String(), 10, 64)
+			if err == nil {
+				return strconv.FormatInt(i, 10), nil
+			}
+		}
+		return "", newError(codeInvalidArgument, fmt.Sprintf("Field %q must be an integer", field.Path))
+	case argBoolean:
+		if b, ok := value.(bool); ok {
+			return strconv.FormatBool(b), nil
+		}
+		return "", newError(codeInvalidArgument, fmt.Sprintf("Field %q must be true or false", field.Path))
+	case argObject, argArray:
+		_, isObject := value.(map[string]interface{})
+		_, isArray := value.([]interface{})
+		if (field.Type == argObject && !isObject) || (field.Type == argArray && !isArray) {
+			return "", newError(codeInvalidArgument, fmt.Sprintf("Field %q must be an %s", field.Path, field.Type))
+		}
+		valueAsBytes, err := json.Marshal(value)
+		if err != nil {
+			return "", err
+		}
+		return string(valueAsBytes), nil
+	}
+	return "", newError(codeInternal, fmt.Sprintf("Field %q has unknown type %s", field.Path, field.Type))
+}
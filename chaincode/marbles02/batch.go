@@ -0,0 +1,195 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// ==== Batch functions ====
+// initMarbles and transferMarbles take a JSON array of entries, each entry with the fields of the
+// v2 form of initMarble or transferMarble. Every entry is validated before anything is written:
+// if one entry fails, nothing is applied and the error data lists every failing entry.
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["initMarbles","[{\"name\":\"marble1\",\"color\":\"blue\",\"size\":35,\"owner\":\"tom\"},{\"name\":\"marble2\",\"color\":\"red\",\"size\":50,\"owner\":\"tom\"}]"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["transferMarbles","[{\"name\":\"marble1\",\"newOwner\":\"jerry\"},{\"name\":\"marble2\",\"newOwner\":\"bob\"}]"]}'
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// maxBatchSize bounds the read and write sets of a batch transaction
+const maxBatchSize = 500
+
+type entryError struct {
+	Index   int    `json:"index"`
+	Name    string `json:"name,omitempty"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// ============================================================
+// parseBatch - decode the JSON array of entries of a batch function
+// ============================================================
+func parseBatch(args []string) ([]map[string]interface{}, error) {
+	if len(args) != 1 {
+		return nil, newError(codeInvalidArgument, "Incorrect number of arguments. Expecting a JSON array of entries")
+	}
+	entries := []map[string]interface{}{}
+	decoder := json.NewDecoder(bytes.NewReader([]byte(args[0])))
+	decoder.UseNumber()
+	err := decoder.Decode(&entries)
+	if err != nil {
+		return nil, newError(codeInvalidArgument, "Argument must be a JSON array of objects: "+err.Error())
+	}
+	if len(entries) == 0 {
+		return nil, newError(codeInvalidArgument, "The batch is empty")
+	}
+	if len(entries) > maxBatchSize {
+		return nil, newError(codeInvalidArgument, "The batch has "+strconv.Itoa(len(entries))+" entries, the maximum is "+strconv.Itoa(maxBatchSize))
+	}
+	return entries, nil
+}
+
+// ============================================================
+// batchFailure - failure response listing the failing entries, nothing has been written
+// ============================================================
+func batchFailure(function string, failures []entryError) pb.Response {
+	code := failures[0].Code
+	for _, failure := range failures {
+		if failure.Code != code {
+			code = codeInvalidArgument
+		}
+	}
+	failuresAsBytes, err := json.Marshal(failures)
+	if err != nil {
+		return errorResponse(err)
+	}
+	message := fmt.Sprintf("%s: %d entries failed validation, nothing was written. Entry %d: %s",
+		function, len(failures), failures[0].Index, failures[0].Message)
+	return errorWithData(code, message, failuresAsBytes)
+}
+
+// ============================================================
+// initMarbles - request a batch of new marbles, see initMarble
+// ============================================================
+func (t *SimpleChaincode) initMarbles(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	entries, err := parseBatch(args)
+	if err != nil {
+		return errorResponse(err)
+	}
+	fmt.Println("- start initMarbles, entries: ", len(entries))
+
+	// ==== Validate every entry first. Reads do not see the writes of this transaction,
+	// so duplicates inside the batch are checked here ====
+	requests := []*mintRequest{}
+	failures := []entryError{}
+	seen := map[string]int{}
+	for i, entry := range entries {
+		name, _ := entry["name"].(string)
+		positional, err := documentArgs(entry, v2Functions["initMarble"])
+		var request *mintRequest
+		if err == nil {
+			request, err = newMintRequest(stub, positional)
+		}
+		if err == nil {
+			if first, dup := seen[name]; dup {
+				err = newError(codeAlreadyExists, "Marble "+name+" is also requested by entry "+strconv.Itoa(first))
+			}
+		}
+		if err != nil {
+			failures = append(failures, entryError{i, name, errorCode(err), err.Error()})
+			continue
+		}
+		seen[name] = i
+		requests = append(requests, request)
+	}
+	if len(failures) > 0 {
+		return batchFailure("initMarbles", failures)
+	}
+
+	// ==== Then write them all ====
+	for _, request := range requests {
+		err = putMintRequest(stub, request)
+		if err != nil {
+			return errorResponse(err)
+		}
+	}
+
+	fmt.Println("- end initMarbles (mints requested)")
+	return shim.Success(nil)
+}
+
+// ============================================================
+// transferMarbles - transfer a batch of marbles, see transferMarble
+// ============================================================
+func (t *SimpleChaincode) transferMarbles(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	entries, err := parseBatch(args)
+	if err != nil {
+		return errorResponse(err)
+	}
+	fmt.Println("- start transferMarbles, entries: ", len(entries))
+
+	transfers := []*marble{}
+	previousOwners := []string{}
+	failures := []entryError{}
+	seen := map[string]int{}
+	for i, entry := range entries {
+		name, _ := entry["name"].(string)
+		positional, err := documentArgs(entry, v2Functions["transferMarble"])
+		var transferred *marble
+		var previousOwner string
+		if err == nil {
+			if first, dup := seen[name]; dup {
+				// the second transfer would be applied to the marble as it was before the first one
+				err = newError(codeInvalidArgument, "Marble "+name+" is also transferred by entry "+strconv.Itoa(first))
+			}
+		}
+		if err == nil {
+			transferred, previousOwner, err = prepareTransfer(stub, positional[0], strings.ToLower(positional[1]))
+		}
+		if err != nil {
+			failures = append(failures, entryError{i, name, errorCode(err), err.Error()})
+			continue
+		}
+		seen[name] = i
+		transfers = append(transfers, transferred)
+		previousOwners = append(previousOwners, previousOwner)
+	}
+	if len(failures) > 0 {
+		return batchFailure("transferMarbles", failures)
+	}
+
+	for i, transferred := range transfers {
+		err = putMarble(stub, transferred)
+		if err != nil {
+			return errorResponse(err)
+		}
+		err = recordTransfer(stub, transferred, previousOwners[i])
+		if err != nil {
+			return errorResponse(err)
+		}
+	}
+
+	fmt.Println("- end transferMarbles (success)")
+	return shim.Success(nil)
+}
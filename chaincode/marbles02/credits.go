@@ -0,0 +1,278 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// ==== Credits ====
+// A fungible credit token next to the marbles. Admins mint credits, users transfer them.
+// An open trade can add credits on top of its marble (a positive "credits") or ask for them
+// (a negative "credits"). Trades only match when their credits net to zero, and the settlement
+// moves the credits in the same transaction as the marbles.
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["mintCredits","tom","100"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["transferCredits","tom","jerry","25"]}'
+// peer chaincode query -C myc1 -n marbles -c '{"Args":["readCreditBalance","tom"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["openTrade","tom","red","50","blue","35","10"]}'
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+type creditBalance struct {
+	ObjectType string `json:"docType"`
+	User       string `json:"user"`
+	Balance    int64  `json:"balance"`
+}
+
+// creditLeg is the credits a user received in a settlement, negative when paid
+type creditLeg struct {
+	User   string `json:"user"`
+	Amount int64  `json:"amount"`
+}
+
+// ============================================================
+// getCreditBalance - credits of a user, a zero balance if the user never held any
+// ============================================================
+func getCreditBalance(stub shim.ChaincodeStubInterface, user string) (*creditBalance, error) {
+	balanceKey, err := stub.CreateCompositeKey("credit", []string{user})
+	if err != nil {
+		return nil, err
+	}
+	balanceAsBytes, err := stub.GetState(balanceKey)
+	if err != nil {
+		return nil, errors.New("Failed to get credit balance: " + err.Error())
+	}
+	balance := creditBalance{"creditBalance", user, 0}
+	if balanceAsBytes != nil {
+		err = json.Unmarshal(balanceAsBytes, &balance)
+		if err != nil {
+			return nil, errors.New("Failed to decode credit balance of " + user + ": " + err.Error())
+		}
+	}
+	return &balance, nil
+}
+
+func putCreditBalance(stub shim.ChaincodeStubInterface, balance *creditBalance) error {
+	balanceKey, err := stub.CreateCompositeKey("credit", []string{balance.User})
+	if err != nil {
+		return err
+	}
+	balanceAsBytes, err := json.Marshal(balance)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(balanceKey, balanceAsBytes)
+}
+
+// ============================================================
+// parseCreditAmount - a strictly positive amount of credits
+// ============================================================
+func parseCreditAmount(arg string, position string) (int64, error) {
+	amount, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || amount <= 0 {
+		return 0, newError(codeInvalidArgument, position+" argument must be a positive numeric string")
+	}
+	return amount, nil
+}
+
+// ============================================================
+// parseTradeCredits - optional credits of an open trade: paid when positive, asked for when negative.
+// A user cannot offer more credits than they hold.
+// ============================================================
+func parseTradeCredits(stub shim.ChaincodeStubInterface, user string, args []string, index int) (int64, error) {
+	if len(args) <= index || args[index] == "" {
+		return 0, nil
+	}
+	credits, err := strconv.ParseInt(args[index], 10, 64)
+	if err != nil || credits == math.MinInt64 {
+		return 0, newError(codeInvalidArgument, "Credits must be a numeric string")
+	}
+	if credits > 0 {
+		balance, err := getCreditBalance(stub, user)
+		if err != nil {
+			return 0, err
+		}
+		if balance.Balance < credits {
+			return 0, newError(codeFailedPrecondition, fmt.Sprintf("%s offers %d credits but holds %d", user, credits, balance.Balance))
+		}
+	}
+	return credits, nil
+}
+
+// ============================================================
+// creditsNet - credits paid minus credits asked for by matched trades, a match needs 0
+// ============================================================
+func creditsNet(trades ...AnOpenTrade) int64 {
+	net := int64(0)
+	for _, trade := range trades {
+		net += trade.Credits
+	}
+	return net
+}
+
+// ============================================================
+// prepareCreditLegs - check the credits of a settlement and return the balances to write.
+// Payers pay into the match and the users who asked for credits are paid out of it.
+// ============================================================
+func prepareCreditLegs(stub shim.ChaincodeStubInterface, run *settlementRun, trades []AnOpenTrade) ([]creditLeg, []*creditBalance, error) {
+	if creditsNet(trades...) != 0 {
+		return nil, nil, newError(codeFailedPrecondition, "The credits of the matched trades do not net to zero")
+	}
+	legs := []creditLeg{}
+	balances := []*creditBalance{}
+	position := map[string]int{} //a user in several trades gets a single leg
+	for _, trade := range trades {
+		if trade.Credits == 0 {
+			continue
+		}
+		i, seen := position[trade.User]
+		if !seen {
+			balance, err := run.creditBalance(stub, trade.User)
+			if err != nil {
+				return nil, nil, err
+			}
+			i = len(legs)
+			position[trade.User] = i
+			legs = append(legs, creditLeg{trade.User, 0})
+			balances = append(balances, balance)
+		}
+		legs[i].Amount -= trade.Credits
+		balances[i].Balance -= trade.Credits
+	}
+	for _, balance := range balances {
+		if balance.Balance < 0 {
+			return nil, nil, newError(codeFailedPrecondition, "Insufficient credits for "+balance.User)
+		}
+	}
+	return legs, balances, nil
+}
+
+// ============================================================
+// mintCredits - create credits for a user (admin)
+// ============================================================
+func (t *SimpleChaincode) mintCredits(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0      1
+	// "tom", "100"
+	if len(args) != 2 {
+		return errorWithCode(codeInvalidArgument, "Incorrect number of arguments. Expecting user and amount")
+	}
+	user := strings.ToLower(args[0])
+	amount, err := parseCreditAmount(args[1], "2nd")
+	if err != nil {
+		return errorResponse(err)
+	}
+	err = requireUser(stub, user)
+	if err != nil {
+		return errorResponse(err)
+	}
+	balance, err := getCreditBalance(stub, user)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if balance.Balance > math.MaxInt64-amount {
+		return errorWithCode(codeInvalidArgument, "The balance of "+user+" would overflow")
+	}
+	balance.Balance += amount
+	err = putCreditBalance(stub, balance)
+	if err != nil {
+		return errorResponse(err)
+	}
+	fmt.Printf("- end mintCredits: %d to %s\n", amount, user)
+	return shim.Success(nil)
+}
+
+// ============================================================
+// transferCredits - move credits from one user to another
+// ============================================================
+func (t *SimpleChaincode) transferCredits(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0      1        2
+	// "tom", "jerry", "25"
+	if len(args) != 3 {
+		return errorWithCode(codeInvalidArgument, "Incorrect number of arguments. Expecting 3")
+	}
+	from := strings.ToLower(args[0])
+	to := strings.ToLower(args[1])
+	amount, err := parseCreditAmount(args[2], "3rd")
+	if err != nil {
+		return errorResponse(err)
+	}
+	if from == to {
+		return errorWithCode(codeInvalidArgument, "Cannot transfer credits to the same user")
+	}
+	err = requireUserOrAdmin(stub, from, "transferCredits")
+	if err != nil {
+		return errorResponse(err)
+	}
+	err = requireUser(stub, to)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	fromBalance, err := getCreditBalance(stub, from)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if fromBalance.Balance < amount {
+		return errorWithCode(codeFailedPrecondition, fmt.Sprintf("%s holds %d credits, cannot transfer %d", from, fromBalance.Balance, amount))
+	}
+	toBalance, err := getCreditBalance(stub, to)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if toBalance.Balance > math.MaxInt64-amount {
+		return errorWithCode(codeInvalidArgument, "The balance of "+to+" would overflow")
+	}
+	fromBalance.Balance -= amount
+	toBalance.Balance += amount
+	for _, balance := range []*creditBalance{fromBalance, toBalance} {
+		err = putCreditBalance(stub, balance)
+		if err != nil {
+			return errorResponse(err)
+		}
+	}
+	fmt.Printf("- end transferCredits: %d from %s to %s\n", amount, from, to)
+	return shim.Success(nil)
+}
+
+// ============================================================
+// readCreditBalance - read the credit balance of a user
+// ============================================================
+func (t *SimpleChaincode) readCreditBalance(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return errorWithCode(codeInvalidArgument, "Incorrect number of arguments. Expecting user")
+	}
+	balance, err := getCreditBalance(stub, strings.ToLower(args[0]))
+	if err != nil {
+		return errorResponse(err)
+	}
+	balanceAsBytes, err := json.Marshal(balance)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return shim.Success(balanceAsBytes)
+}
@@ -0,0 +1,288 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// ==== Custodian attestation ====
+// initMarble only requests a mint. A registered custodian approves the request, which creates the
+// marble with an attestation attached, or rejects it.
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["setCustodian","vault","true"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["initMarble","marble1","blue","35","tom","","vault"]}'
+// peer chaincode query -C myc1 -n marbles -c '{"Args":["readMintRequest","marble1"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["approveMint","marble1","vault","inspected at vault 3"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["approveMint","marble1","vault","inspected","SN-0001","9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08",""]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["rejectMint","marble1","vault","chipped"]}'
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+type mintRequest struct {
+	ObjectType     string `json:"docType"`             //docType is used to distinguish the various types of objects in state database
+	Marble         marble `json:"marble"`              //the marble as it will be created
+	Custodian      string `json:"custodian,omitempty"` //custodian asked to approve, any custodian if empty
+	RequesterMSPID string `json:"requesterMspid"`
+	Requester      string `json:"requester"` //enrolled identity of the requester
+	Requested      int64  `json:"requested"`
+}
+
+type attestation struct {
+	Custodian string `json:"custodian"`
+	TxID      string `json:"txId"` //transaction that approved the mint
+	Timestamp int64  `json:"timestamp"`
+	Note      string `json:"note,omitempty"`
+}
+
+// ============================================================
+// getMintRequest - read a pending mint request, nil if there is none
+// ============================================================
+func getMintRequest(stub shim.ChaincodeStubInterface, marbleName string) (*mintRequest, error) {
+	requestKey, err := stub.CreateCompositeKey("mintRequest", []string{marbleName})
+	if err != nil {
+		return nil, err
+	}
+	requestAsBytes, err := stub.GetState(requestKey)
+	if err != nil {
+		return nil, errors.New("Failed to get mint request: " + err.Error())
+	} else if requestAsBytes == nil {
+		return nil, nil
+	}
+
+	request := mintRequest{}
+	err = json.Unmarshal(requestAsBytes, &request)
+	if err != nil {
+		return nil, errors.New("Failed to decode mint request " + marbleName + ": " + err.Error())
+	}
+	upgradeMarble(&request.Marble)
+	return &request, nil
+}
+
+func putMintRequest(stub shim.ChaincodeStubInterface, request *mintRequest) error {
+	requestKey, err := stub.CreateCompositeKey("mintRequest", []string{request.Marble.Name})
+	if err != nil {
+		return err
+	}
+	request.Marble.SchemaVersion = marbleSchemaVersion
+	requestAsBytes, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(requestKey, requestAsBytes)
+}
+
+func delMintRequest(stub shim.ChaincodeStubInterface, marbleName string) error {
+	requestKey, err := stub.CreateCompositeKey("mintRequest", []string{marbleName})
+	if err != nil {
+		return err
+	}
+	return stub.DelState(requestKey)
+}
+
+// ============================================================
+// requireCustodian - return an error unless handle is a registered custodian and the caller is that custodian
+// ============================================================
+func requireCustodian(stub shim.ChaincodeStubInterface, handle string, function string) error {
+	custodian, err := getUser(stub, handle)
+	if err != nil {
+		return err
+	}
+	if custodian == nil || !custodian.Custodian {
+		return newError(codeForbidden, handle+" is not a registered custodian")
+	}
+	self, err := callerIsUser(stub, handle)
+	if err != nil {
+		return err
+	}
+	if !self {
+		return newError(codeForbidden, function+" must be signed by custodian "+handle)
+	}
+	return nil
+}
+
+// ============================================================
+// setCustodian - grant or revoke the custodian role of a registered user
+// ============================================================
+func (t *SimpleChaincode) setCustodian(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0         1
+	// "vault", "true"
+	if len(args) != 2 {
+		return errorWithCode(codeInvalidArgument, "Incorrect number of arguments. Expecting 2")
+	}
+	if args[1] != "true" && args[1] != "false" {
+		return errorWithCode(codeInvalidArgument, "2nd argument must be true or false")
+	}
+
+	handle := strings.ToLower(args[0])
+	custodian, err := getUser(stub, handle)
+	if err != nil {
+		return errorResponse(err)
+	} else if custodian == nil {
+		return errorWithCode(codeNotFound, "User does not exist: "+handle)
+	}
+
+	custodian.Custodian = args[1] == "true"
+	err = putUser(stub, custodian)
+	if err != nil {
+		return errorResponse(err)
+	}
+	fmt.Println("- end setCustodian " + handle + " " + args[1])
+	return shim.Success(nil)
+}
+
+// ============================================================
+// approveMint - custodian vouches for the physical object and the marble is created
+// ============================================================
+func (t *SimpleChaincode) approveMint(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0          1         2            3           4          5
+	// "marble1", "vault", ["inspected", ["SN-0001", ["9f86...", ["a665..."]]]]
+	if len(args) < 2 || len(args) > 6 {
+		return errorWithCode(codeInvalidArgument, "Incorrect number of arguments. Expecting 2 to 6")
+	}
+
+	marbleName := args[0]
+	custodian := strings.ToLower(args[1])
+	note := ""
+	if len(args) >= 3 {
+		note = args[2]
+	}
+	binding := physicalBinding{}
+	if len(args) > 3 {
+		fields := make([]string, 3) //missing binding fields are left unset
+		copy(fields, args[3:])
+		var err error
+		binding, err = parsePhysicalBinding(fields[0], fields[1], fields[2])
+		if err != nil {
+			return errorResponse(err)
+		}
+	}
+	fmt.Println("- start approveMint ", marbleName, custodian)
+
+	request, err := getMintRequest(stub, marbleName)
+	if err != nil {
+		return errorResponse(err)
+	} else if request == nil {
+		return errorWithCode(codeNotFound, "Mint request does not exist: "+marbleName)
+	}
+	if request.Custodian != "" && request.Custodian != custodian {
+		return errorWithCode(codeForbidden, "Mint request "+marbleName+" is assigned to custodian "+request.Custodian)
+	}
+	err = requireCustodian(stub, custodian, "approveMint")
+	if err != nil {
+		return errorResponse(err)
+	}
+	err = requireUser(stub, request.Marble.Owner)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	// ==== Attach the attestation and the physical binding, then create the marble ====
+	approved, err := txTimestamp(stub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	newMarble := request.Marble
+	newMarble.Status = marbleStatusActive
+	newMarble.Attestation = &attestation{custodian, stub.GetTxID(), approved, note}
+	err = applyPhysicalBinding(stub, &newMarble, binding)
+	if err != nil {
+		return errorResponse(err)
+	}
+	err = createMarble(stub, &newMarble)
+	if err != nil {
+		return errorResponse(err)
+	}
+	err = delMintRequest(stub, marbleName)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	fmt.Println("- end approveMint (success)")
+	return shim.Success(nil)
+}
+
+// ============================================================
+// rejectMint - custodian or admin drops a mint request
+// ============================================================
+func (t *SimpleChaincode) rejectMint(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0          1         2
+	// "marble1", "vault", "chipped"
+	if len(args) != 3 {
+		return errorWithCode(codeInvalidArgument, "Incorrect number of arguments. Expecting 3")
+	}
+
+	marbleName := args[0]
+	custodian := strings.ToLower(args[1])
+	fmt.Println("- start rejectMint ", marbleName, custodian, args[2])
+
+	request, err := getMintRequest(stub, marbleName)
+	if err != nil {
+		return errorResponse(err)
+	} else if request == nil {
+		return errorWithCode(codeNotFound, "Mint request does not exist: "+marbleName)
+	}
+
+	err = requireCustodian(stub, custodian, "rejectMint")
+	if err != nil {
+		admin, adminErr := isAdmin(stub)
+		if adminErr != nil {
+			return errorResponse(adminErr)
+		}
+		if !admin {
+			return errorResponse(err)
+		}
+	}
+
+	err = delMintRequest(stub, marbleName)
+	if err != nil {
+		return errorResponse(err)
+	}
+	fmt.Println("- end rejectMint (success)")
+	return shim.Success(nil)
+}
+
+// ============================================================
+// readMintRequest - read a pending mint request
+// ============================================================
+func (t *SimpleChaincode) readMintRequest(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return errorWithCode(codeInvalidArgument, "Incorrect number of arguments. Expecting name of the requested marble")
+	}
+
+	request, err := getMintRequest(stub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	} else if request == nil {
+		return errorWithCode(codeNotFound, "Mint request does not exist: "+args[0])
+	}
+
+	requestAsBytes, err := json.Marshal(request)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return shim.Success(requestAsBytes)
+}
@@ -0,0 +1,339 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// ==== Trading fees ====
+// Each call to setFeeSchedule stores a new version of the fee schedule: a fee per settled leg,
+// paid by the user giving the marble, and a fee per cycle, split evenly between the users of a
+// matched settlement (the first trade pays the remainder). Fees are charged on settlements made
+// by the matchers, using the latest schedule, and debited from the users' fee balances.
+// Users fund their fee balance from their credits with depositFees; the fees are credited to the
+// credit balance of the operator named in the schedule. A user short of fees is not settled.
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["setFeeSchedule","2","3","operator"]}'
+// peer chaincode query -C myc1 -n marbles -c '{"Args":["readFeeSchedule"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["depositFees","tom","20"]}'
+// peer chaincode query -C myc1 -n marbles -c '{"Args":["readFeeBalance","tom"]}'
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+type feeSchedule struct {
+	ObjectType string `json:"docType"`
+	Version    int    `json:"version"`
+	PerLeg     int64  `json:"perLeg"`   //paid by the user giving each marble
+	PerCycle   int64  `json:"perCycle"` //split between the users of a settlement
+	Operator   string `json:"operator"` //user credited with the fees
+	TxID       string `json:"txId"`
+	Timestamp  int64  `json:"timestamp"`
+}
+
+type feeBalance struct {
+	ObjectType string `json:"docType"`
+	User       string `json:"user"`
+	Balance    int64  `json:"balance"`
+}
+
+// feeCharge is the fee a user paid for a settlement
+type feeCharge struct {
+	User   string `json:"user"`
+	Amount int64  `json:"amount"`
+}
+
+// ============================================================
+// getFeeSchedule - read a fee schedule version, or the latest one when version is 0.
+// Returns nil if no schedule was set.
+// ============================================================
+func getFeeSchedule(stub shim.ChaincodeStubInterface, version int) (*feeSchedule, error) {
+	var scheduleAsBytes []byte
+	if version > 0 {
+		key, err := stub.CreateCompositeKey("feeSchedule", []string{fmt.Sprintf("%08d", version)})
+		if err != nil {
+			return nil, err
+		}
+		scheduleAsBytes, err = stub.GetState(key)
+		if err != nil {
+			return nil, errors.New("Failed to get fee schedule: " + err.Error())
+		}
+	} else {
+		resultsIterator, err := stub.GetStateByPartialCompositeKey("feeSchedule", []string{})
+		if err != nil {
+			return nil, err
+		}
+		defer resultsIterator.Close()
+		// keys are ordered by padded version, the last one is the latest
+		for resultsIterator.HasNext() {
+			queryResponse, err := resultsIterator.Next()
+			if err != nil {
+				return nil, err
+			}
+			scheduleAsBytes = queryResponse.Value
+		}
+	}
+	if scheduleAsBytes == nil {
+		return nil, nil
+	}
+	schedule := feeSchedule{}
+	err := json.Unmarshal(scheduleAsBytes, &schedule)
+	if err != nil {
+		return nil, errors.New("Failed to decode fee schedule: " + err.Error())
+	}
+	return &schedule, nil
+}
+
+func getFeeBalance(stub shim.ChaincodeStubInterface, user string) (*feeBalance, error) {
+	balanceKey, err := stub.CreateCompositeKey("feeBalance", []string{user})
+	if err != nil {
+		return nil, err
+	}
+	balanceAsBytes, err := stub.GetState(balanceKey)
+	if err != nil {
+		return nil, errors.New("Failed to get fee balance: " + err.Error())
+	}
+	balance := feeBalance{"feeBalance", user, 0}
+	if balanceAsBytes != nil {
+		err = json.Unmarshal(balanceAsBytes, &balance)
+		if err != nil {
+			return nil, errors.New("Failed to decode fee balance of " + user + ": " + err.Error())
+		}
+	}
+	return &balance, nil
+}
+
+func putFeeBalance(stub shim.ChaincodeStubInterface, balance *feeBalance) error {
+	balanceKey, err := stub.CreateCompositeKey("feeBalance", []string{balance.User})
+	if err != nil {
+		return err
+	}
+	balanceAsBytes, err := json.Marshal(balance)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(balanceKey, balanceAsBytes)
+}
+
+// ============================================================
+// prepareFees - fees of a matched settlement under the latest schedule, with the balances to write.
+// creditBalances are the credit balances the settlement already changes, so the operator's is
+// updated in place when the operator takes part in the settlement.
+// ============================================================
+func prepareFees(stub shim.ChaincodeStubInterface, run *settlementRun, legs []swapLeg, creditBalances []*creditBalance) (*feeSchedule, []feeCharge, []*feeBalance, []*creditBalance, error) {
+	schedule, err := getFeeSchedule(stub, 0)
+	if err != nil || schedule == nil || (schedule.PerLeg == 0 && schedule.PerCycle == 0) {
+		return nil, nil, nil, creditBalances, err
+	}
+
+	// ==== Per leg fees, then the cycle fee split between the users in leg order ====
+	charges := []feeCharge{}
+	position := map[string]int{}
+	for _, leg := range legs {
+		if _, seen := position[leg.Owner]; !seen {
+			position[leg.Owner] = len(charges)
+			charges = append(charges, feeCharge{leg.Owner, 0})
+		}
+		charges[position[leg.Owner]].Amount += schedule.PerLeg
+	}
+	share := schedule.PerCycle / int64(len(charges))
+	for i := range charges {
+		charges[i].Amount += share
+	}
+	charges[0].Amount += schedule.PerCycle - share*int64(len(charges))
+
+	total := int64(0)
+	balances := []*feeBalance{}
+	for _, charge := range charges {
+		balance, err := run.feeBalance(stub, charge.User)
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+		if balance.Balance < charge.Amount {
+			return nil, nil, nil, nil, newError(codeFailedPrecondition,
+				fmt.Sprintf("%s owes %d in fees but has a fee balance of %d", charge.User, charge.Amount, balance.Balance))
+		}
+		balance.Balance -= charge.Amount
+		balances = append(balances, balance)
+		total += charge.Amount
+	}
+
+	var operator *creditBalance
+	for _, balance := range creditBalances {
+		if balance.User == schedule.Operator {
+			operator = balance
+		}
+	}
+	if operator == nil {
+		operator, err = run.creditBalance(stub, schedule.Operator)
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+		creditBalances = append(creditBalances, operator)
+	}
+	operator.Balance += total
+	return schedule, charges, balances, creditBalances, nil
+}
+
+// ============================================================
+// setFeeSchedule - store a new version of the fee schedule (admin)
+// ============================================================
+func (t *SimpleChaincode) setFeeSchedule(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0      1      2
+	// "2",   "3",   "operator"
+	if len(args) != 3 {
+		return errorWithCode(codeInvalidArgument, "Incorrect number of arguments. Expecting fee per leg, fee per cycle and operator")
+	}
+	perLeg, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil || perLeg < 0 {
+		return errorWithCode(codeInvalidArgument, "1st argument must be a non-negative numeric string")
+	}
+	perCycle, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil || perCycle < 0 {
+		return errorWithCode(codeInvalidArgument, "2nd argument must be a non-negative numeric string")
+	}
+	operator := strings.ToLower(args[2])
+	err = requireUser(stub, operator)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	latest, err := getFeeSchedule(stub, 0)
+	if err != nil {
+		return errorResponse(err)
+	}
+	timestamp, err := txTimestamp(stub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	schedule := feeSchedule{"feeSchedule", 1, perLeg, perCycle, operator, stub.GetTxID(), timestamp}
+	if latest != nil {
+		schedule.Version = latest.Version + 1
+	}
+	key, err := stub.CreateCompositeKey("feeSchedule", []string{fmt.Sprintf("%08d", schedule.Version)})
+	if err != nil {
+		return errorResponse(err)
+	}
+	scheduleAsBytes, err := json.Marshal(schedule)
+	if err != nil {
+		return errorResponse(err)
+	}
+	err = stub.PutState(key, scheduleAsBytes)
+	if err != nil {
+		return errorResponse(err)
+	}
+	fmt.Println("- end setFeeSchedule, version " + strconv.Itoa(schedule.Version))
+	return shim.Success(scheduleAsBytes)
+}
+
+// ============================================================
+// readFeeSchedule - read the latest fee schedule, or a given version
+// ============================================================
+func (t *SimpleChaincode) readFeeSchedule(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) > 1 {
+		return errorWithCode(codeInvalidArgument, "Incorrect number of arguments. Expecting an optional version")
+	}
+	version := 0
+	if len(args) == 1 {
+		var err error
+		version, err = strconv.Atoi(args[0])
+		if err != nil || version <= 0 {
+			return errorWithCode(codeInvalidArgument, "Version must be a positive numeric string")
+		}
+	}
+	schedule, err := getFeeSchedule(stub, version)
+	if err != nil {
+		return errorResponse(err)
+	} else if schedule == nil {
+		return errorWithCode(codeNotFound, "Fee schedule does not exist")
+	}
+	scheduleAsBytes, err := json.Marshal(schedule)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return shim.Success(scheduleAsBytes)
+}
+
+// ============================================================
+// depositFees - move credits of a user to their fee balance
+// ============================================================
+func (t *SimpleChaincode) depositFees(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0      1
+	// "tom", "20"
+	if len(args) != 2 {
+		return errorWithCode(codeInvalidArgument, "Incorrect number of arguments. Expecting user and amount")
+	}
+	user := strings.ToLower(args[0])
+	amount, err := parseCreditAmount(args[1], "2nd")
+	if err != nil {
+		return errorResponse(err)
+	}
+	err = requireUserOrAdmin(stub, user, "depositFees")
+	if err != nil {
+		return errorResponse(err)
+	}
+	credits, err := getCreditBalance(stub, user)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if credits.Balance < amount {
+		return errorWithCode(codeFailedPrecondition, fmt.Sprintf("%s holds %d credits, cannot deposit %d", user, credits.Balance, amount))
+	}
+	fees, err := getFeeBalance(stub, user)
+	if err != nil {
+		return errorResponse(err)
+	}
+	credits.Balance -= amount
+	fees.Balance += amount
+	err = putCreditBalance(stub, credits)
+	if err != nil {
+		return errorResponse(err)
+	}
+	err = putFeeBalance(stub, fees)
+	if err != nil {
+		return errorResponse(err)
+	}
+	fmt.Printf("- end depositFees: %d for %s\n", amount, user)
+	return shim.Success(nil)
+}
+
+// ============================================================
+// readFeeBalance - read the fee balance of a user
+// ============================================================
+func (t *SimpleChaincode) readFeeBalance(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return errorWithCode(codeInvalidArgument, "Incorrect number of arguments. Expecting user")
+	}
+	balance, err := getFeeBalance(stub, strings.ToLower(args[0]))
+	if err != nil {
+		return errorResponse(err)
+	}
+	balanceAsBytes, err := json.Marshal(balance)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return shim.Success(balanceAsBytes)
+}
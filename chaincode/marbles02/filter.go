@@ -0,0 +1,220 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// ==== Transfer by filter ====
+// Move the marbles matching a filter to a new owner. Every filter is optional, pass "" to skip it:
+// color, minimum and maximum size, current owner and the maximum number of marbles to move.
+// With dryRun "true" nothing is written and the response lists the marbles that would move.
+// The caller must be the current owner given in the filter, or an admin.
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["transferMarblesByFilter","jerry","blue","10","40","tom","5","false"]}'
+// peer chaincode query -C myc1 -n marbles -c '{"Args":["transferMarblesByFilter","jerry","","","","tom","","true"]}'
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+type marbleFilter struct {
+	Color    string `json:"color,omitempty"`
+	MinSize  int    `json:"minSize,omitempty"`
+	MaxSize  int    `json:"maxSize,omitempty"` //0 for no upper bound
+	Owner    string `json:"owner,omitempty"`
+	MaxCount int    `json:"maxCount,omitempty"` //0 for no limit
+}
+
+type filterTransferResult struct {
+	NewOwner string   `json:"newOwner"`
+	DryRun   bool     `json:"dryRun"`
+	Count    int      `json:"count"`
+	Marbles  []marble `json:"marbles"` //the marbles as they were before the transfer
+}
+
+func (f marbleFilter) matches(m *marble) bool {
+	if f.Color != "" && m.Color != f.Color {
+		return false
+	}
+	if m.Size < f.MinSize || (f.MaxSize > 0 && m.Size > f.MaxSize) {
+		return false
+	}
+	return f.Owner == "" || m.Owner == f.Owner
+}
+
+// ============================================================
+// parseFilterInt - optional non-negative integer argument, 0 if empty
+// ============================================================
+func parseFilterInt(arg string, position string) (int, error) {
+	if arg == "" {
+		return 0, nil
+	}
+	value, err := strconv.Atoi(arg)
+	if err != nil || value < 0 {
+		return 0, newError(codeInvalidArgument, position+" argument must be empty or a non-negative numeric string")
+	}
+	return value, nil
+}
+
+// ============================================================
+// selectMarbles - find the active marbles matching a filter, in color~name index order.
+// The index is read with range queries, which committing peers re-execute, so the
+// selection is safe to use in an update transaction (unlike a rich query).
+// ============================================================
+func selectMarbles(stub shim.ChaincodeStubInterface, filter marbleFilter) ([]*marble, error) {
+	prefix := []string{}
+	if filter.Color != "" {
+		prefix = []string{filter.Color}
+	}
+	resultsIterator, err := stub.GetStateByPartialCompositeKey("color~name", prefix)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	selected := []*marble{}
+	for resultsIterator.HasNext() {
+		if filter.MaxCount > 0 && len(selected) >= filter.MaxCount {
+			break
+		}
+		responseRange, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		_, compositeKeyParts, err := stub.SplitCompositeKey(responseRange.Key)
+		if err != nil {
+			return nil, err
+		}
+		m, err := getMarble(stub, compositeKeyParts[1])
+		if err != nil {
+			return nil, err
+		}
+		// locked marbles and stale index entries are skipped
+		if m == nil || m.Status != marbleStatusActive || !filter.matches(m) {
+			continue
+		}
+		selected = append(selected, m)
+	}
+	return selected, nil
+}
+
+// ============================================================
+// transferSelected - move the selected marbles to newOwner, or only list them on a dry run
+// ============================================================
+func transferSelected(stub shim.ChaincodeStubInterface, filter marbleFilter, newOwner string, dryRun bool) (filterTransferResult, error) {
+	result := filterTransferResult{NewOwner: newOwner, DryRun: dryRun, Marbles: []marble{}}
+	err := requireUser(stub, newOwner)
+	if err != nil {
+		return result, err
+	}
+	selected, err := selectMarbles(stub, filter)
+	if err != nil {
+		return result, err
+	}
+	for _, m := range selected {
+		result.Marbles = append(result.Marbles, *m)
+		if dryRun {
+			continue
+		}
+		previousOwner := m.Owner
+		m.Owner = newOwner
+		m.Settlement = ""
+		err = putMarble(stub, m)
+		if err != nil {
+			return result, err
+		}
+		err = recordTransfer(stub, m, previousOwner)
+		if err != nil {
+			return result, err
+		}
+	}
+	result.Count = len(selected)
+	return result, nil
+}
+
+// ============================================================
+// transferMarblesByFilter - transfer the marbles matching a filter to a new owner
+// ============================================================
+func (t *SimpleChaincode) transferMarblesByFilter(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0        1         2      3       4        5      6
+	// "jerry", ["blue", ["10", ["40", ["tom", ["5", ["true"]]]]]]
+	if len(args) < 1 || len(args) > 7 {
+		return errorWithCode(codeInvalidArgument, "Incorrect number of arguments. Expecting 1 to 7")
+	}
+	filterArgs := make([]string, 7) //missing filters are left empty
+	copy(filterArgs, args)
+
+	newOwner := strings.ToLower(filterArgs[0])
+	if newOwner == "" {
+		return errorWithCode(codeInvalidArgument, "1st argument must be a non-empty string")
+	}
+	filter := marbleFilter{Color: strings.ToLower(filterArgs[1]), Owner: strings.ToLower(filterArgs[4])}
+	var err error
+	filter.MinSize, err = parseFilterInt(filterArgs[2], "3rd")
+	if err != nil {
+		return errorResponse(err)
+	}
+	filter.MaxSize, err = parseFilterInt(filterArgs[3], "4th")
+	if err != nil {
+		return errorResponse(err)
+	}
+	if filter.MaxSize > 0 && filter.MaxSize < filter.MinSize {
+		return errorWithCode(codeInvalidArgument, "Maximum size is lower than minimum size")
+	}
+	filter.MaxCount, err = parseFilterInt(filterArgs[5], "6th")
+	if err != nil {
+		return errorResponse(err)
+	}
+	if filterArgs[6] != "" && filterArgs[6] != "true" && filterArgs[6] != "false" {
+		return errorWithCode(codeInvalidArgument, "7th argument must be empty, true or false")
+	}
+	dryRun := filterArgs[6] == "true"
+	fmt.Println("- start transferMarblesByFilter ", newOwner, filter, dryRun)
+
+	// ==== Owners move their own marbles, an admin can move anyone's ====
+	admin, err := isAdmin(stub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if !admin {
+		if filter.Owner == "" {
+			return errorWithCode(codeForbidden, "transferMarblesByFilter without an owner filter requires the admin role")
+		}
+		err = requireUserOrAdmin(stub, filter.Owner, "transferMarblesByFilter")
+		if err != nil {
+			return errorResponse(err)
+		}
+	}
+
+	result, err := transferSelected(stub, filter, newOwner, dryRun)
+	if err != nil {
+		return errorResponse(err)
+	}
+	resultAsBytes, err := json.Marshal(result)
+	if err != nil {
+		return errorResponse(err)
+	}
+	fmt.Printf("- end transferMarblesByFilter: %d marbles\n", result.Count)
+	return shim.Success(resultAsBytes)
+}
@@ -0,0 +1,174 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// ==== Marble history ====
+// getHistoryForMarble returns one typed record per transaction that wrote the marble, oldest first.
+// Optional arguments bound the time range, both ends inclusive and given in RFC 3339, and page the
+// records; the bookmark of a page is the transaction ID of its last record.
+// peer chaincode query -C myc1 -n marbles -c '{"Args":["getHistoryForMarble","marble1"]}'
+// peer chaincode query -C myc1 -n marbles -c '{"Args":["getHistoryForMarble","marble1","2018-06-01T00:00:00Z","2018-07-01T00:00:00Z","10",""]}'
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+type historyRecord struct {
+	TxID      string          `json:"txId"`
+	Timestamp string          `json:"timestamp"` //RFC 3339
+	IsDelete  bool            `json:"isDelete"`
+	Status    string          `json:"status"` //status of the marble after the transaction, "deleted" for a delete
+	Value     json.RawMessage `json:"value"`  //the marble as written, null for a delete
+}
+
+type historyPage struct {
+	Records             []historyRecord `json:"records"`
+	Bookmark            string          `json:"bookmark"` //empty on the last page
+	FetchedRecordsCount int32           `json:"fetchedRecordsCount"`
+}
+
+// ============================================================
+// parseHistoryTime - optional RFC 3339 bound of the history time range, nil if empty
+// ============================================================
+func parseHistoryTime(arg string, position string) (*time.Time, error) {
+	if arg == "" {
+		return nil, nil
+	}
+	bound, err := time.Parse(time.RFC3339, arg)
+	if err != nil {
+		return nil, newError(codeInvalidArgument, position+" argument must be empty or an RFC 3339 time, e.g. 2018-06-01T00:00:00Z")
+	}
+	return &bound, nil
+}
+
+// ============================================================
+// historyStatus - status of a marble history value, "deleted" for deletes
+// ============================================================
+func historyStatus(value []byte, isDelete bool) string {
+	if isDelete {
+		return "deleted"
+	}
+	m := marble{}
+	err := json.Unmarshal(value, &m)
+	if err != nil {
+		return "unknown"
+	}
+	upgradeMarble(&m)
+	return m.Status
+}
+
+// ============================================================
+// getHistoryForMarble - history of the values of a marble
+// ============================================================
+func (t *SimpleChaincode) getHistoryForMarble(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0          1                        2                        3       4
+	// "marble1", ["2018-06-01T00:00:00Z", ["2018-07-01T00:00:00Z", ["10", ["bookmark"]]]]
+	if len(args) < 1 || len(args) > 5 {
+		return errorWithCode(codeInvalidArgument, "Incorrect number of arguments. Expecting 1 to 5")
+	}
+	marbleName := args[0]
+	historyArgs := make([]string, 5) //missing arguments are left empty
+	copy(historyArgs, args)
+
+	from, err := parseHistoryTime(historyArgs[1], "2nd")
+	if err != nil {
+		return errorResponse(err)
+	}
+	to, err := parseHistoryTime(historyArgs[2], "3rd")
+	if err != nil {
+		return errorResponse(err)
+	}
+	paginated := historyArgs[3] != ""
+	var pageSize int32
+	bookmark := historyArgs[4]
+	if paginated {
+		pageSize, bookmark, err = parsePageArgs(historyArgs[3:])
+		if err != nil {
+			return errorResponse(err)
+		}
+	}
+	fmt.Printf("- start getHistoryForMarble: %s\n", marbleName)
+
+	resultsIterator, err := stub.GetHistoryForKey(marbleName)
+	if err != nil {
+		return errorResponse(err)
+	}
+	defer resultsIterator.Close()
+
+	page := historyPage{Records: []historyRecord{}}
+	skipping := bookmark != "" //the history API has no bookmarks, skip up to the last record of the previous page
+	for resultsIterator.HasNext() {
+		modification, err := resultsIterator.Next()
+		if err != nil {
+			return errorResponse(err)
+		}
+		if skipping {
+			skipping = modification.TxId != bookmark
+			continue
+		}
+		var at time.Time
+		if modification.Timestamp != nil {
+			at = time.Unix(modification.Timestamp.Seconds, int64(modification.Timestamp.Nanos)).UTC()
+		}
+		if (from != nil && at.Before(*from)) || (to != nil && at.After(*to)) {
+			continue
+		}
+		if paginated && page.FetchedRecordsCount == pageSize {
+			// there is at least one more record
+			page.Bookmark = page.Records[len(page.Records)-1].TxID
+			break
+		}
+
+		record := historyRecord{modification.TxId, at.Format(time.RFC3339), modification.IsDelete,
+			historyStatus(modification.Value, modification.IsDelete), json.RawMessage("null")}
+		if !modification.IsDelete {
+			record.Value = json.RawMessage(modification.Value)
+			if !json.Valid(modification.Value) {
+				record.Value, err = json.Marshal(string(modification.Value))
+				if err != nil {
+					return errorResponse(err)
+				}
+			}
+		}
+		page.Records = append(page.Records, record)
+		page.FetchedRecordsCount++
+	}
+	if skipping {
+		return errorWithCode(codeInvalidArgument, "Bookmark "+bookmark+" is not a transaction of "+marbleName)
+	}
+
+	var resultAsBytes []byte
+	if paginated {
+		resultAsBytes, err = json.Marshal(page)
+	} else {
+		resultAsBytes, err = json.Marshal(page.Records)
+	}
+	if err != nil {
+		return errorResponse(err)
+	}
+	fmt.Printf("- getHistoryForMarble returning:\n%s\n", string(resultAsBytes))
+	return shim.Success(resultAsBytes)
+}
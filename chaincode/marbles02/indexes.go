@@ -0,0 +1,483 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// ==== Index integrity ====
+// The marble documents are the source of truth for the composite indexes:
+//   color~name  one entry per marble that is not burned
+//   tag~name    one entry per bound tag hash, kept after the marble is burned
+// verifyIndexes reports index entries without a matching marble (orphaned) and marbles
+// without their index entries (missing). rebuildIndexes (admin) regenerates the indexes in
+// batches: pass the returned bookmark to the next call until it is empty.
+// peer chaincode query -C myc1 -n marbles -c '{"Args":["verifyIndexes"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["rebuildIndexes","100",""]}'
+
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// marbleIndexes lists the composite indexes built from the marble documents, in rebuild order
+var marbleIndexes = []string{"color~name", "tag~name"}
+
+const defaultRebuildBatchSize = 100
+
+type indexProblem struct {
+	Index      string   `json:"index"`
+	Attributes []string `json:"attributes"`
+	Marble     string   `json:"marble"`
+	Problem    string   `json:"problem"`
+}
+
+type indexReport struct {
+	CheckedMarbles int            `json:"checkedMarbles"`
+	CheckedEntries int            `json:"checkedEntries"`
+	Orphaned       []indexProblem `json:"orphaned"`
+	Missing        []indexProblem `json:"missing"`
+}
+
+type rebuildResult struct {
+	Phase     string         `json:"phase"` //"marbles" or the index cleaned up by this batch
+	Written   int            `json:"written"`
+	Removed   int            `json:"removed"`
+	Orphaned  int            `json:"orphaned"`  //orphaned entries found by this batch, removed by the next call
+	Conflicts []indexProblem `json:"conflicts"` //entries that could not be written, e.g. a tag claimed by two marbles
+	Bookmark  string         `json:"bookmark"`  //pass to the next call, "" once every phase is done
+	Done      bool           `json:"done"`
+}
+
+// ============================================================
+// putColorIndex / delColorIndex - maintain the color~name index of a marble
+// ============================================================
+func putColorIndex(stub shim.ChaincodeStubInterface, m *marble) error {
+	colorNameIndexKey, err := stub.CreateCompositeKey("color~name", []string{m.Color, m.Name})
+	if err != nil {
+		return err
+	}
+	//  Note - passing a 'nil' value will effectively delete the key from state, therefore we pass null character as value
+	return stub.PutState(colorNameIndexKey, []byte{0x00})
+}
+
+func delColorIndex(stub shim.ChaincodeStubInterface, m *marble) error {
+	colorNameIndexKey, err := stub.CreateCompositeKey("color~name", []string{m.Color, m.Name})
+	if err != nil {
+		return err
+	}
+	return stub.DelState(colorNameIndexKey)
+}
+
+// ============================================================
+// expectedIndexEntries - the index entries a marble should have, as index, attributes and value
+// ============================================================
+func expectedIndexEntries(m *marble) []indexProblem {
+	entries := []indexProblem{}
+	if m.Status != marbleStatusBurned {
+		entries = append(entries, indexProblem{Index: "color~name", Attributes: []string{m.Color, m.Name}, Marble: m.Name})
+	}
+	if m.Physical != nil && m.Physical.TagHash != "" {
+		entries = append(entries, indexProblem{Index: "tag~name", Attributes: []string{m.Physical.TagHash}, Marble: m.Name})
+	}
+	return entries
+}
+
+// ============================================================
+// checkExpectedEntry - why the index entry of a marble is missing, "" if it is in place
+// ============================================================
+func checkExpectedEntry(stub shim.ChaincodeStubInterface, entry indexProblem) (string, error) {
+	key, err := stub.CreateCompositeKey(entry.Index, entry.Attributes)
+	if err != nil {
+		return "", err
+	}
+	value, err := stub.GetState(key)
+	if err != nil {
+		return "", err
+	}
+	if value == nil {
+		return "no index entry", nil
+	}
+	if entry.Index == "tag~name" && string(value) != entry.Marble {
+		return "tag is bound to marble " + string(value), nil
+	}
+	return "", nil
+}
+
+// ============================================================
+// checkIndexEntry - the marble an index entry points to and why the entry is orphaned, "" if it is not
+// ============================================================
+func checkIndexEntry(stub shim.ChaincodeStubInterface, index string, attributes []string, value []byte) (string, string, error) {
+	marbleName := ""
+	if index == "color~name" && len(attributes) == 2 {
+		marbleName = attributes[1]
+	} else if index == "tag~name" && len(attributes) == 1 {
+		marbleName = string(value)
+	} else {
+		return "", "malformed index key", nil
+	}
+
+	m, err := getMarble(stub, marbleName)
+	if err != nil {
+		return marbleName, "", err
+	}
+	if m == nil {
+		return marbleName, "marble does not exist", nil
+	}
+	if index == "color~name" {
+		if m.Status == marbleStatusBurned {
+			return marbleName, "marble is burned", nil
+		}
+		if m.Color != attributes[0] {
+			return marbleName, "marble color is " + m.Color, nil
+		}
+	} else if m.Physical == nil || m.Physical.TagHash != attributes[0] {
+		return marbleName, "marble is not bound to this tag", nil
+	}
+	return marbleName, "", nil
+}
+
+// ============================================================
+// forEachMarble - call fn for the marble documents from startKey on, reading at most limit keys (0 for no limit).
+// Returns the key to start the next batch from, "" when the end is reached.
+// An empty end key makes the range open ended; composite keys are not part of simple key ranges.
+// ============================================================
+func forEachMarble(stub shim.ChaincodeStubInterface, startKey string, limit int, fn func(m *marble) error) (string, error) {
+	resultsIterator, err := stub.GetStateByRange(startKey, "")
+	if err != nil {
+		return "", err
+	}
+	defer resultsIterator.Close()
+
+	read := 0
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return "", err
+		}
+		if limit > 0 && read == limit {
+			return queryResponse.Key, nil
+		}
+		read++
+
+		// the same key range holds open trades and configuration, only marbles are indexed
+		doc := struct {
+			ObjectType string `json:"docType"`
+		}{}
+		if json.Unmarshal(queryResponse.Value, &doc) != nil || doc.ObjectType != "marble" {
+			continue
+		}
+		m := marble{}
+		err = json.Unmarshal(queryResponse.Value, &m)
+		if err != nil {
+			return "", err
+		}
+		upgradeMarble(&m)
+		err = fn(&m)
+		if err != nil {
+			return "", err
+		}
+	}
+	return "", nil
+}
+
+// ============================================================
+// forEachIndexEntry - call fn for the entries of an index. With a limit, only the page of at most limit entries
+// starting at the Fabric bookmark is read, and the bookmark of the next page is returned, "" at the end.
+// Fabric does not allow writes in a transaction that made a paginated query, so fn must not write then.
+// ============================================================
+func forEachIndexEntry(stub shim.ChaincodeStubInterface, index string, bookmark string, limit int,
+	fn func(key string, attributes []string, value []byte) error) (string, error) {
+	var resultsIterator shim.StateQueryIteratorInterface
+	var err error
+	next := ""
+	if limit > 0 {
+		var metadata *pb.QueryResponseMetadata
+		resultsIterator, metadata, err = stub.GetStateByPartialCompositeKeyWithPagination(index, []string{}, int32(limit), bookmark)
+		if err == nil && metadata != nil && metadata.FetchedRecordsCount == int32(limit) {
+			next = metadata.Bookmark
+		}
+	} else {
+		resultsIterator, err = stub.GetStateByPartialCompositeKey(index, []string{})
+	}
+	if err != nil {
+		return "", err
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return "", err
+		}
+		_, attributes, err := stub.SplitCompositeKey(queryResponse.Key)
+		if err != nil {
+			return "", err
+		}
+		err = fn(queryResponse.Key, attributes, queryResponse.Value)
+		if err != nil {
+			return "", err
+		}
+	}
+	return next, nil
+}
+
+// ============================================================
+// verifyIndexes - report orphaned and missing index entries
+// ============================================================
+func (t *SimpleChaincode) verifyIndexes(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	report := indexReport{Orphaned: []indexProblem{}, Missing: []indexProblem{}}
+
+	// ==== Every marble has its entries ====
+	_, err := forEachMarble(stub, "", 0, func(m *marble) error {
+		report.CheckedMarbles++
+		for _, entry := range expectedIndexEntries(m) {
+			problem, err := checkExpectedEntry(stub, entry)
+			if err != nil {
+				return err
+			}
+			if problem != "" {
+				entry.Problem = problem
+				report.Missing = append(report.Missing, entry)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	// ==== Every entry points to a marble ====
+	for _, index := range marbleIndexes {
+		_, err = forEachIndexEntry(stub, index, "", 0, func(key string, attributes []string, value []byte) error {
+			report.CheckedEntries++
+			marbleName, problem, err := checkIndexEntry(stub, index, attributes, value)
+			if err != nil {
+				return err
+			}
+			if problem != "" {
+				report.Orphaned = append(report.Orphaned, indexProblem{index, attributes, marbleName, problem})
+			}
+			return nil
+		})
+		if err != nil {
+			return errorResponse(err)
+		}
+	}
+
+	reportAsBytes, err := json.Marshal(report)
+	if err != nil {
+		return errorResponse(err)
+	}
+	fmt.Printf("- end verifyIndexes: %d orphaned, %d missing\n", len(report.Orphaned), len(report.Missing))
+	return shim.Success(reportAsBytes)
+}
+
+// removePhase marks the batch that removes the orphaned entries found by the previous batch of an index
+const removePhase = "/remove"
+
+// rebuildRemoval - the orphaned entries of one page of an index and the Fabric bookmark of the next page
+type rebuildRemoval struct {
+	Keys []string `json:"keys"`
+	Next string   `json:"next"`
+}
+
+// ============================================================
+// parseRebuildBookmark - "<phase>:<hex key>", "" for the first batch
+// ============================================================
+func parseRebuildBookmark(bookmark string) (string, string, error) {
+	if bookmark == "" {
+		return "marbles", "", nil
+	}
+	parts := strings.SplitN(bookmark, ":", 2)
+	key, err := hex.DecodeString(parts[len(parts)-1])
+	if len(parts) != 2 || err != nil {
+		return "", "", newError(codeInvalidArgument, "Invalid bookmark: "+bookmark)
+	}
+	if parts[0] == "marbles" {
+		return parts[0], string(key), nil
+	}
+	for _, index := range marbleIndexes {
+		if parts[0] == index || parts[0] == index+removePhase {
+			return parts[0], string(key), nil
+		}
+	}
+	return "", "", newError(codeInvalidArgument, "Invalid bookmark: "+bookmark)
+}
+
+func rebuildBookmark(phase string, key string) string {
+	return phase + ":" + hex.EncodeToString([]byte(key))
+}
+
+// afterIndexBookmark - the bookmark of the phase after the given index, "" after the last one
+func afterIndexBookmark(index string) string {
+	for i := range marbleIndexes {
+		if marbleIndexes[i] == index && i+1 < len(marbleIndexes) {
+			return rebuildBookmark(marbleIndexes[i+1], "")
+		}
+	}
+	return ""
+}
+
+// ============================================================
+// rebuildIndexes - regenerate the composite indexes from the marble documents, one batch per call.
+// The marbles phase writes missing entries, then one phase per index finds orphaned entries a page
+// at a time and removes them in the following call.
+// ============================================================
+func (t *SimpleChaincode) rebuildIndexes(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0        1
+	// ["100", ["marbles:6d6172626c653130"]]
+	if len(args) > 2 {
+		return errorWithCode(codeInvalidArgument, "Incorrect number of arguments. Expecting 0 to 2")
+	}
+	batchSize := defaultRebuildBatchSize
+	if len(args) > 0 && args[0] != "" {
+		var err error
+		batchSize, err = strconv.Atoi(args[0])
+		if err != nil || batchSize <= 0 || batchSize > maxBatchSize {
+			return errorWithCode(codeInvalidArgument, "1st argument must be a batch size from 1 to "+strconv.Itoa(maxBatchSize))
+		}
+	}
+	bookmark := ""
+	if len(args) > 1 {
+		bookmark = args[1]
+	}
+	phase, key, err := parseRebuildBookmark(bookmark)
+	if err != nil {
+		return errorResponse(err)
+	}
+	fmt.Println("- start rebuildIndexes ", phase, batchSize)
+
+	result := rebuildResult{Phase: phase, Conflicts: []indexProblem{}}
+	next := ""
+	if phase == "marbles" {
+		// reads do not see the writes of this transaction, so tags claimed in this batch are tracked here
+		claimed := map[string]string{}
+		next, err = forEachMarble(stub, key, batchSize, func(m *marble) error {
+			for _, entry := range expectedIndexEntries(m) {
+				problem, err := checkExpectedEntry(stub, entry)
+				if err != nil {
+					return err
+				}
+				if entry.Index == "tag~name" {
+					if owner, ok := claimed[entry.Attributes[0]]; ok && owner != m.Name {
+						problem = "tag is bound to marble " + owner
+					}
+				}
+				if problem == "" {
+					continue
+				}
+				if problem != "no index entry" {
+					entry.Problem = problem
+					result.Conflicts = append(result.Conflicts, entry)
+					continue
+				}
+				if entry.Index == "color~name" {
+					err = putColorIndex(stub, m)
+				} else {
+					err = putTagIndex(stub, entry.Attributes[0], m.Name)
+					claimed[entry.Attributes[0]] = m.Name
+				}
+				if err != nil {
+					return err
+				}
+				result.Written++
+			}
+			return nil
+		})
+		if err == nil && next != "" {
+			result.Bookmark = rebuildBookmark("marbles", next)
+		} else if err == nil {
+			result.Bookmark = rebuildBookmark(marbleIndexes[0], "")
+		}
+	} else if strings.HasSuffix(phase, removePhase) {
+		// remove what the previous batch found, checking each entry again since it may have been repaired
+		index := strings.TrimSuffix(phase, removePhase)
+		result.Phase = index
+		removal := rebuildRemoval{}
+		if json.Unmarshal([]byte(key), &removal) != nil {
+			return errorWithCode(codeInvalidArgument, "Invalid bookmark: "+bookmark)
+		}
+		for _, entryKey := range removal.Keys {
+			value, err := stub.GetState(entryKey)
+			if err != nil {
+				return errorResponse(err)
+			} else if value == nil {
+				continue
+			}
+			_, attributes, err := stub.SplitCompositeKey(entryKey)
+			if err != nil {
+				return errorResponse(err)
+			}
+			_, problem, err := checkIndexEntry(stub, index, attributes, value)
+			if err != nil {
+				return errorResponse(err)
+			} else if problem == "" {
+				continue
+			}
+			err = stub.DelState(entryKey)
+			if err != nil {
+				return errorResponse(err)
+			}
+			result.Removed++
+		}
+		if removal.Next != "" {
+			result.Bookmark = rebuildBookmark(index, removal.Next)
+		} else {
+			result.Bookmark = afterIndexBookmark(index)
+		}
+	} else {
+		// a paginated read starts at the bookmark, but the transaction cannot write, so the orphaned
+		// entries of the page are passed to the next call in the bookmark
+		orphans := []string{}
+		next, err = forEachIndexEntry(stub, phase, key, batchSize, func(entryKey string, attributes []string, value []byte) error {
+			_, problem, err := checkIndexEntry(stub, phase, attributes, value)
+			if err != nil || problem == "" {
+				return err
+			}
+			orphans = append(orphans, entryKey)
+			return nil
+		})
+		result.Orphaned = len(orphans)
+		if err == nil && len(orphans) > 0 {
+			removalAsBytes, _ := json.Marshal(rebuildRemoval{orphans, next})
+			result.Bookmark = rebuildBookmark(phase+removePhase, string(removalAsBytes))
+		} else if err == nil && next != "" {
+			result.Bookmark = rebuildBookmark(phase, next)
+		} else if err == nil {
+			result.Bookmark = afterIndexBookmark(phase)
+		}
+	}
+	if err != nil {
+		return errorResponse(err)
+	}
+	result.Done = result.Bookmark == ""
+
+	resultAsBytes, err := json.Marshal(result)
+	if err != nil {
+		return errorResponse(err)
+	}
+	fmt.Printf("- end rebuildIndexes %s: %d written, %d removed\n", phase, result.Written, result.Removed)
+	return shim.Success(resultAsBytes)
+}
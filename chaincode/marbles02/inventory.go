@@ -0,0 +1,92 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// ==== Match run inventory ====
+// One match run can settle several cycles, and reads in a transaction do not see its own writes.
+// The run therefore keeps the tradable marbles of each color it needs as of the start of the run
+// and the marbles it has already given away, so no marble is given twice in a run.
+// A marble received in a run can be traded from the next run on.
+
+package main
+
+import (
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// ============================================================
+// tradableMarbles - names of the active marbles of a color by owner, read through the color~name index
+// in key order, so every endorser selects the same marbles and the reads are checked at commit
+// ============================================================
+func tradableMarbles(stub shim.ChaincodeStubInterface, color string) (map[string][]string, error) {
+	selected, err := selectMarbles(stub, marbleFilter{Color: color})
+	if err != nil {
+		return nil, err
+	}
+	byOwner := map[string][]string{}
+	for _, m := range selected {
+		byOwner[m.Owner] = append(byOwner[m.Owner], m.Name)
+	}
+	return byOwner, nil
+}
+
+// ============================================================
+// pickMarbles - a different marble for each leg, with the index of the first leg whose owner has none left,
+// -1 if every leg has one. Marbles given earlier in the run are skipped unless includeGiven is set.
+// ============================================================
+func (run *settlementRun) pickMarbles(stub shim.ChaincodeStubInterface, legs []swapLeg, includeGiven bool) ([]string, int, error) {
+	names := []string{}
+	picked := map[string]bool{}
+	for i, leg := range legs {
+		inventory, ok := run.inventory[leg.Color]
+		if !ok {
+			var err error
+			inventory, err = tradableMarbles(stub, leg.Color)
+			if err != nil {
+				return nil, -1, err
+			}
+			run.inventory[leg.Color] = inventory
+		}
+		name := ""
+		for _, candidate := range inventory[leg.Owner] {
+			if !picked[candidate] && (includeGiven || !run.given[candidate]) {
+				name = candidate
+				break
+			}
+		}
+		if name == "" {
+			return nil, i, nil
+		}
+		picked[name] = true
+		names = append(names, name)
+	}
+	return names, -1, nil
+}
+
+// ============================================================
+// exhausted - whether the legs cannot be settled only because the marbles they need were given earlier in the run.
+// The matchers skip such a cycle and leave its trades open for the next run.
+// ============================================================
+func (run *settlementRun) exhausted(stub shim.ChaincodeStubInterface, legs []swapLeg) (bool, error) {
+	_, short, err := run.pickMarbles(stub, legs, false)
+	if err != nil || short < 0 {
+		return false, err
+	}
+	_, short, err = run.pickMarbles(stub, legs, true)
+	return err == nil && short < 0, err
+}
@@ -0,0 +1,154 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// ==== Open trade limits ====
+// Keep one user from flooding AllOpenTrades: a user may have at most maxOpenTrades open trades,
+// and opening a trade with the same Want and Willing as one of the user's open trades is either
+// rejected or merged into the open one, which then takes the new credits.
+// Until an admin sets them, the limits are 20 open trades per user and duplicates are rejected.
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["setTradeLimits","50","merge"]}'
+// peer chaincode query -C myc1 -n marbles -c '{"Args":["readTradeLimits"]}'
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+var tradeLimitsStr = "_tradelimits" //name for the key/value that will store the open trade limits
+
+// what to do with a trade identical to an open trade of the same user
+const (
+	duplicateReject = "reject"
+	duplicateMerge  = "merge"
+)
+
+type tradeLimits struct {
+	MaxOpenTrades int    `json:"maxOpenTrades"` //per user, 0 for no limit
+	Duplicates    string `json:"duplicates"`    //reject or merge
+}
+
+var defaultTradeLimits = tradeLimits{20, duplicateReject}
+
+func getTradeLimits(stub shim.ChaincodeStubInterface) (tradeLimits, error) {
+	limitsAsBytes, err := stub.GetState(tradeLimitsStr)
+	if err != nil {
+		return tradeLimits{}, errors.New("Failed to get trade limits: " + err.Error())
+	} else if limitsAsBytes == nil {
+		return defaultTradeLimits, nil
+	}
+	limits := tradeLimits{}
+	err = json.Unmarshal(limitsAsBytes, &limits)
+	if err != nil {
+		return tradeLimits{}, errors.New("Failed to decode trade limits: " + err.Error())
+	}
+	return limits, nil
+}
+
+// ============================================================
+// findDuplicateTrade - index of an open trade of the same user with the same Want and Willing, -1 if none.
+// The trade with the given timestamp is skipped, so a trade being amended is not its own duplicate.
+// ============================================================
+func findDuplicateTrade(trades []AnOpenTrade, open AnOpenTrade, skipTimestamp int64) int {
+	for i, trade := range trades {
+		if trade.User == open.User && trade.Timestamp != skipTimestamp &&
+			reflect.DeepEqual(trade.Want, open.Want) && reflect.DeepEqual(trade.Willing, open.Willing) {
+			return i
+		}
+	}
+	return -1
+}
+
+// ============================================================
+// duplicateTradeError - the error reported for a trade identical to an open one
+// ============================================================
+func duplicateTradeError(existing AnOpenTrade) error {
+	return newError(codeAlreadyExists, fmt.Sprintf("%s already has an open trade wanting %s/%d for %s/%d, timestamp %d",
+		existing.User, existing.Want.Color, existing.Want.Size, existing.Willing.Color, existing.Willing.Size, existing.Timestamp))
+}
+
+// ============================================================
+// checkOpenTradeLimit - error unless the user can open one more trade
+// ============================================================
+func checkOpenTradeLimit(limits tradeLimits, trades []AnOpenTrade, user string) error {
+	if limits.MaxOpenTrades == 0 {
+		return nil
+	}
+	count := 0
+	for _, trade := range trades {
+		if trade.User == user {
+			count++
+		}
+	}
+	if count >= limits.MaxOpenTrades {
+		return newError(codeFailedPrecondition, fmt.Sprintf("%s already has %d open trades, the maximum is %d", user, count, limits.MaxOpenTrades))
+	}
+	return nil
+}
+
+// ============================================================
+// setTradeLimits - set the maximum open trades per user and the duplicate policy (admin)
+// ============================================================
+func (t *SimpleChaincode) setTradeLimits(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0      1
+	// "50", "merge"
+	if len(args) != 2 {
+		return errorWithCode(codeInvalidArgument, "Incorrect number of arguments. Expecting maximum open trades and duplicate policy")
+	}
+	maxOpenTrades, err := strconv.Atoi(args[0])
+	if err != nil || maxOpenTrades < 0 {
+		return errorWithCode(codeInvalidArgument, "1st argument must be a non-negative numeric string, 0 for no limit")
+	}
+	if args[1] != duplicateReject && args[1] != duplicateMerge {
+		return errorWithCode(codeInvalidArgument, "2nd argument must be reject or merge")
+	}
+	limitsAsBytes, err := json.Marshal(tradeLimits{maxOpenTrades, args[1]})
+	if err != nil {
+		return errorResponse(err)
+	}
+	err = stub.PutState(tradeLimitsStr, limitsAsBytes)
+	if err != nil {
+		return errorResponse(err)
+	}
+	fmt.Println("- end setTradeLimits " + string(limitsAsBytes))
+	return shim.Success(limitsAsBytes)
+}
+
+// ============================================================
+// readTradeLimits - read the open trade limits
+// ============================================================
+func (t *SimpleChaincode) readTradeLimits(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	limits, err := getTradeLimits(stub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	limitsAsBytes, err := json.Marshal(limits)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return shim.Success(limitsAsBytes)
+}
@@ -23,17 +23,22 @@ under the License.
 // peer chaincode invoke -C myc1 -n marbles -c '{"Args":["initMarble","marble1","blue","35","tom"]}'
 // peer chaincode invoke -C myc1 -n marbles -c '{"Args":["initMarble","marble2","red","50","tom"]}'
 // peer chaincode invoke -C myc1 -n marbles -c '{"Args":["initMarble","marble3","blue","70","tom"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["initMarble","marble4","green","20","tom","{\"material\":\"glass\",\"year\":1962}"]}'
 // peer chaincode invoke -C myc1 -n marbles -c '{"Args":["transferMarble","marble2","jerry"]}'
 // peer chaincode invoke -C myc1 -n marbles -c '{"Args":["transferMarblesBasedOnColor","blue","jerry"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["transferMarblesByFilter","jerry","blue","","","tom","5"]}'
 // peer chaincode invoke -C myc1 -n marbles -c '{"Args":["delete","marble1"]}'
 
 // ==== Query marbles ====
 // peer chaincode query -C myc1 -n marbles -c '{"Args":["readMarble","marble1"]}'
 // peer chaincode query -C myc1 -n marbles -c '{"Args":["getMarblesByRange","marble1","marble3"]}'
+// peer chaincode query -C myc1 -n marbles -c '{"Args":["getMarblesByRange","marble1","marble9","3",""]}'
 // peer chaincode query -C myc1 -n marbles -c '{"Args":["getHistoryForMarble","marble1"]}'
+// peer chaincode query -C myc1 -n marbles -c '{"Args":["getHistoryForMarble","marble1","2018-06-01T00:00:00Z","","10",""]}'
 
 // Rich Query (Only supported if CouchDB is used as state database):
 //   peer chaincode query -C myc1 -n marbles -c '{"Args":["queryMarblesByOwner","tom"]}'
+//   peer chaincode query -C myc1 -n marbles -c '{"Args":["queryMarblesByOwner","tom","3",""]}'
 //   peer chaincode query -C myc1 -n marbles -c '{"Args":["queryMarbles","{\"selector\":{\"owner\":\"tom\"}}"]}'
 
 //The following examples demonstrate creating indexes on CouchDB
@@ -77,11 +82,12 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strconv"
 	"strings"
-	"time"
 	"reflect"
+	"sort"
 	
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	pb "github.com/hyperledger/fabric/protos/peer"
@@ -92,13 +98,28 @@ type SimpleChaincode struct {
 }
 
 type marble struct {
-	ObjectType string `json:"docType"` //docType is used to distinguish the various types of objects in state database
-	Name       string `json:"name"`    //the fieldtags are needed to keep case from bouncing around
-	Color      string `json:"color"`
-	Size       int    `json:"size"`
-	Owner      string `json:"owner"`
+	ObjectType       string                 `json:"docType"` //docType is used to distinguish the various types of objects in state database
+	Name             string                 `json:"name"`    //the fieldtags are needed to keep case from bouncing around
+	Color            string                 `json:"color"`
+	Size             int                    `json:"size"`
+	Owner            string                 `json:"owner"`
+	SchemaVersion    int                    `json:"schemaVersion"`              //layout version of this document, see upgradeMarble
+	Attributes       map[string]interface{} `json:"attributes,omitempty"`       //validated against the marble asset class schema
+	AttributesSchema int                    `json:"attributesSchema,omitempty"` //version of the asset class schema the attributes were validated against
+	Physical         *physicalBinding       `json:"physical,omitempty"`         //ties the record to its physical object
+	Status           string                 `json:"status"`                     //only active marbles can be transferred or traded
+	Attestation      *attestation           `json:"attestation,omitempty"`      //custodian approval of the mint
+	Redemption       *redemption            `json:"redemption,omitempty"`       //set once the owner asks for the physical marble
+	LastUpdate       *marbleUpdate          `json:"lastUpdate,omitempty"`       //who changed the properties of the marble last and why
+	Settlement       string                 `json:"settlement,omitempty"`       //settlement that gave the marble to its owner, empty after a plain transfer
 }
 
+// marbleSchemaVersion is the layout version written by this chaincode.
+// Older documents are upgraded when they are read and saved in the new layout on their next write.
+const marbleSchemaVersion = 2
+
+const marbleStatusActive = "active"
+
 type Description struct{
 	Color string `json:"color"`
 	Size int `json:"size"`
@@ -110,6 +131,7 @@ type AnOpenTrade struct{
 	Timestamp int64 `json:"timestamp"`	
 	Want Description  `json:"want"`				//description of desired marble
 	Willing Description `json:"willing"`		//marbles willing to trade away
+	Credits int64 `json:"credits,omitempty"`		//credits paid on top of the marble, negative for credits asked for
 }
 
 type AllOpenTrades struct{
@@ -131,15 +153,44 @@ func main() {
 // Init initializes chaincode
 // ===========================
 func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
-	return shim.Success(nil)
+	_, args := stub.GetFunctionAndParameters()
+	err := initAdmins(stub, args)
+	if err != nil {
+		return wrapResponse(errorResponse(err))
+	}
+	return wrapResponse(shim.Success(nil))
 }
 
 // Invoke - Our entry point for Invocations
+// Every function answers with the response envelope, see wrapResponse
 // ========================================
 func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
+	return wrapResponse(t.invoke(stub))
+}
+
+// invoke - route the invocation to the function
+// ========================================
+func (t *SimpleChaincode) invoke(stub shim.ChaincodeStubInterface) pb.Response {
 	function, args := stub.GetFunctionAndParameters()
 	fmt.Println("invoke is running " + function)
 
+	// API v2 functions take one JSON document, convert it to the positional arguments
+	if strings.HasPrefix(function, apiV2Prefix) {
+		var err error
+		function, args, err = convertV2Call(function, args)
+		if err != nil {
+			return errorResponse(err)
+		}
+	}
+
+	// Operational functions require the admin role
+	if adminFunctions[function] {
+		err := requireAdmin(stub, function)
+		if err != nil {
+			return errorResponse(err)
+		}
+	}
+
 	// Handle different functions
 	if function == "initMarble" { //create a new marble
 		return t.initMarble(stub, args)
@@ -147,6 +198,10 @@ func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 		return t.transferMarble(stub, args)
 	} else if function == "transferMarblesBasedOnColor" { //transfer all marbles of a certain color
 		return t.transferMarblesBasedOnColor(stub, args)
+	} else if function == "updateMarble" { //change the color, size or attributes of a marble
+		return t.updateMarble(stub, args)
+	} else if function == "transferMarblesByFilter" { //transfer the marbles matching color, size and owner filters
+		return t.transferMarblesByFilter(stub, args)
 	} else if function == "delete" { //delete a marble
 		return t.delete(stub, args)
 	} else if function == "readMarble" { //read a marble
@@ -181,70 +236,235 @@ func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 		return t.matchTriTrade(stub, args)
 	} else if function == "clearOpenTrades" { // match the open trades
 		return t.clearOpenTrades(stub, args)
+	} else if function == "addAdmin" { // grant the admin role
+		return t.addAdmin(stub, args)
+	} else if function == "removeAdmin" { // revoke the admin role
+		return t.removeAdmin(stub, args)
+	} else if function == "readAdmins" { // read the admin list
+		return t.readAdmins(stub, args)
+	} else if function == "registerUser" { // bind a user handle to an enrolled identity
+		return t.registerUser(stub, args)
+	} else if function == "readUser" { // read a registered user
+		return t.readUser(stub, args)
+	} else if function == "listUsers" { // list all registered users
+		return t.listUsers(stub, args)
+	} else if function == "defineSchema" { // store a new attribute schema version for an asset class
+		return t.defineSchema(stub, args)
+	} else if function == "readSchema" { // read an asset class schema
+		return t.readSchema(stub, args)
+	} else if function == "bindMarble" { // bind a marble to its physical object
+		return t.bindMarble(stub, args)
+	} else if function == "readMarbleByTag" { // find a marble by the hash of its physical tag
+		return t.readMarbleByTag(stub, args)
+	} else if function == "setCustodian" { // grant or revoke the custodian role of a user
+		return t.setCustodian(stub, args)
+	} else if function == "approveMint" { // custodian approves a mint request into a marble
+		return t.approveMint(stub, args)
+	} else if function == "rejectMint" { // custodian or admin rejects a mint request
+		return t.rejectMint(stub, args)
+	} else if function == "readMintRequest" { // read a pending mint request
+		return t.readMintRequest(stub, args)
+	} else if function == "requestRedemption" { // owner asks for the physical marble, the marble is locked
+		return t.requestRedemption(stub, args)
+	} else if function == "cancelRedemption" { // unlock a marble waiting for redemption
+		return t.cancelRedemption(stub, args)
+	} else if function == "confirmRedemption" { // custodian hands the marble over, the marble is burned
+		return t.confirmRedemption(stub, args)
+	} else if function == "readSettlement" { // read the record of a settled swap
+		return t.readSettlement(stub, args)
+	} else if function == "getOwnershipTimeline" { // ownership periods of a marble
+		return t.getOwnershipTimeline(stub, args)
+	} else if function == "mintCredits" { // create credits for a user
+		return t.mintCredits(stub, args)
+	} else if function == "transferCredits" {
+		return t.transferCredits(stub, args)
+	} else if function == "readCreditBalance" {
+		return t.readCreditBalance(stub, args)
+	} else if function == "getReputation" { // fill, cancel and failure counters of a user
+		return t.getReputation(stub, args)
+	} else if function == "setFeeSchedule" { // store a new version of the fee schedule
+		return t.setFeeSchedule(stub, args)
+	} else if function == "readFeeSchedule" {
+		return t.readFeeSchedule(stub, args)
+	} else if function == "depositFees" { // move credits to the fee balance
+		return t.depositFees(stub, args)
+	} else if function == "readFeeBalance" {
+		return t.readFeeBalance(stub, args)
+	} else if function == "setTradeLimits" { // set the maximum open trades per user and the duplicate policy
+		return t.setTradeLimits(stub, args)
+	} else if function == "readTradeLimits" {
+		return t.readTradeLimits(stub, args)
+	} else if function == "setSelfTradePolicy" { // set what the matchers do with cycles of repeated users
+		return t.setSelfTradePolicy(stub, args)
+	} else if function == "readSelfTradePolicy" {
+		return t.readSelfTradePolicy(stub, args)
+	} else if function == "openSealedRound" { // start the commit and reveal windows of sealed intents
+		return t.openSealedRound(stub, args)
+	} else if function == "readSealedRound" {
+		return t.readSealedRound(stub, args)
+	} else if function == "commitTradeIntent" { // submit the hash of a sealed intent
+		return t.commitTradeIntent(stub, args)
+	} else if function == "revealTradeIntent" { // reveal a sealed intent
+		return t.revealTradeIntent(stub, args)
+	} else if function == "closeSealedRound" { // add the revealed intents to the open trades
+		return t.closeSealedRound(stub, args)
+	} else if function == "openPrivateTrade" { // open a trade kept in the private data collection
+		return t.openPrivateTrade(stub, args)
+	} else if function == "readPrivateTrade" {
+		return t.readPrivateTrade(stub, args)
+	} else if function == "removePrivateTrade" {
+		return t.removePrivateTrade(stub, args)
+	} else if function == "matchPrivateTrades" { // match the private trades in pair
+		return t.matchPrivateTrades(stub, args)
+	} else if function == "getProvenance" { // history of a marble with a hash chain
+		return t.getProvenance(stub, args)
+	} else if function == "getUserActivity" { // everything a user minted, traded and transferred
+		return t.getUserActivity(stub, args)
+	} else if function == "amendOpenTrade" { // change what an open trade wants or gives
+		return t.amendOpenTrade(stub, args)
+	} else if function == "verifyIndexes" { // report orphaned and missing index entries
+		return t.verifyIndexes(stub, args)
+	} else if function == "rebuildIndexes" { // regenerate the composite indexes in batches
+		return t.rebuildIndexes(stub, args)
+	} else if function == "initMarbles" { // request a batch of new marbles
+		return t.initMarbles(stub, args)
+	} else if function == "transferMarbles" { // transfer a batch of marbles
+		return t.transferMarbles(stub, args)
 	}
 	
 	fmt.Println("invoke did not find func: " + function) //error
-	return shim.Error("Received unknown function invocation")
+	return errorWithCode(codeInvalidArgument, "Received unknown function invocation")
 }
 
 // ============================================================
-// initMarble - create a new marble, store into chaincode state
+// initMarble - request a new marble. The marble is stored into chaincode state
+// once a custodian approves the request, see approveMint.
 // ============================================================
 func (t *SimpleChaincode) initMarble(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	var err error
 	fmt.Println("testing init Marble2")
-	//   0       1       2     3
-	// "asdf", "blue", "35", "bob"
-	if len(args) != 4 {
-		return shim.Error("Incorrect number of arguments. Expecting 4")
+	request, err := newMintRequest(stub, args)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	// === Save the mint request, the custodian approves it into a marble ===
+	err = putMintRequest(stub, request)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	fmt.Println("- end init marble (mint requested)")
+	return shim.Success(nil)
+}
+
+// ============================================================
+// newMintRequest - validate the arguments of initMarble and build the mint request. Nothing is written.
+// ============================================================
+func newMintRequest(stub shim.ChaincodeStubInterface, args []string) (*mintRequest, error) {
+	var err error
+	//   0       1       2     3              4                     5
+	// "asdf", "blue", "35", "bob", ["{\"material\":\"glass\"}", "vault"]
+	if len(args) < 4 || len(args) > 6 {
+		return nil, newError(codeInvalidArgument, "Incorrect number of arguments. Expecting 4 to 6")
 	}
 
 	// ==== Input sanitation ====
 	fmt.Println("- start init marble")
 	if len(args[0]) <= 0 {
-		return shim.Error("1st argument must be a non-empty string")
+		return nil, newError(codeInvalidArgument, "1st argument must be a non-empty string")
 	}
 	if len(args[1]) <= 0 {
-		return shim.Error("2nd argument must be a non-empty string")
+		return nil, newError(codeInvalidArgument, "2nd argument must be a non-empty string")
 	}
 	if len(args[2]) <= 0 {
-		return shim.Error("3rd argument must be a non-empty string")
+		return nil, newError(codeInvalidArgument, "3rd argument must be a non-empty string")
 	}
 	if len(args[3]) <= 0 {
-		return shim.Error("4th argument must be a non-empty string")
+		return nil, newError(codeInvalidArgument, "4th argument must be a non-empty string")
 	}
 	marbleName := args[0]
 	color := strings.ToLower(args[1])
 	owner := strings.ToLower(args[3])
 	size, err := strconv.Atoi(args[2])
 	if err != nil {
-		return shim.Error("3rd argument must be a numeric string")
+		return nil, newError(codeInvalidArgument, "3rd argument must be a numeric string")
+	}
+	err = requireUser(stub, owner)
+	if err != nil {
+		return nil, err
 	}
 
-	// ==== Check if marble already exists ====
+	// ==== Validate attributes against the marble schema ====
+	var attributes map[string]interface{}
+	if len(args) >= 5 && len(args[4]) > 0 {
+		err = json.Unmarshal([]byte(args[4]), &attributes)
+		if err != nil {
+			return nil, newError(codeInvalidArgument, "5th argument must be a JSON object of attributes: " + err.Error())
+		}
+	}
+	schema, err := getSchema(stub, "marble", 0)
+	if err != nil {
+		return nil, err
+	}
+	err = validateAttributes(schema, attributes)
+	if err != nil {
+		return nil, err
+	}
+
+	// ==== The requested custodian, if any, must be a registered custodian ====
+	custodian := ""
+	if len(args) == 6 && len(args[5]) > 0 {
+		custodian = strings.ToLower(args[5])
+		registered, err := getUser(stub, custodian)
+		if err != nil {
+			return nil, err
+		} else if registered == nil || !registered.Custodian {
+			return nil, newError(codeInvalidArgument, custodian + " is not a registered custodian")
+		}
+	}
+
+	// ==== Check if marble or a request for it already exists ====
 	marbleAsBytes, err := stub.GetState(marbleName)
 	if err != nil {
-		return shim.Error("Failed to get marble: " + err.Error())
+		return nil, errors.New("Failed to get marble: " + err.Error())
 	} else if marbleAsBytes != nil {
 		fmt.Println("This marble already exists: " + marbleName)
-		return shim.Error("This marble already exists: " + marbleName)
+		return nil, newError(codeAlreadyExists, "This marble already exists: " + marbleName)
+	}
+	pending, err := getMintRequest(stub, marbleName)
+	if err != nil {
+		return nil, err
+	} else if pending != nil {
+		return nil, newError(codeAlreadyExists, "A mint request already exists for marble: " + marbleName)
 	}
 
-	// ==== Create marble object and marshal to JSON ====
+	// ==== Create marble object ====
 	objectType := "marble"
-	marble := &marble{objectType, marbleName, color, size, owner}
-	marbleJSONasBytes, err := json.Marshal(marble)
+	marble := marble{ObjectType: objectType, Name: marbleName, Color: color, Size: size, Owner: owner, Attributes: attributes}
+	if len(attributes) > 0 {
+		marble.AttributesSchema = schema.Version
+	}
+
+	requesterMSPID, requester, err := getCallerIdentity(stub)
 	if err != nil {
-		return shim.Error(err.Error())
+		return nil, err
+	}
+	requested, err := txTimestamp(stub)
+	if err != nil {
+		return nil, err
 	}
-	//Alternatively, build the marble json string manually if you don't want to use struct marshalling
-	//marbleJSONasString := `{"docType":"Marble",  "name": "` + marbleName + `", "color": "` + color + `", "size": ` + strconv.Itoa(size) + `, "owner": "` + owner + `"}`
-	//marbleJSONasBytes := []byte(str)
+	return &mintRequest{"mintRequest", marble, custodian, requesterMSPID, requester, requested}, nil
+}
+
+// ============================================================
+// createMarble - store a new marble into chaincode state and index it
+// ============================================================
+func createMarble(stub shim.ChaincodeStubInterface, marble *marble) error {
 
 	// === Save marble to state ===
-	err = stub.PutState(marbleName, marbleJSONasBytes)
+	err := putMarble(stub, marble)
 	if err != nil {
-		return shim.Error(err.Error())
+		return err
 	}
 
 	//  ==== Index the marble to enable color-based range queries, e.g. return all blue marbles ====
@@ -252,70 +472,119 @@ func (t *SimpleChaincode) initMarble(stub shim.ChaincodeStubInterface, args []st
 	//  The key is a composite key, with the elements that you want to range query on listed first.
 	//  In our case, the composite key is based on indexName~color~name.
 	//  This will enable very efficient state range queries based on composite keys matching indexName~color~*
-	indexName := "color~name"
-	colorNameIndexKey, err := stub.CreateCompositeKey(indexName, []string{marble.Color, marble.Name})
+	//  Save index entry to state. Only the key name is needed, no need to store a duplicate copy of the marble.
+	err = putColorIndex(stub, marble)
 	if err != nil {
-		return shim.Error(err.Error())
+		return err
+	}
+	err = recordActivity(stub, activity{User: marble.Owner, Kind: activityMinted, Marble: marble.Name, To: marble.Owner})
+	if err != nil {
+		return err
 	}
-	//  Save index entry to state. Only the key name is needed, no need to store a duplicate copy of the marble.
-	//  Note - passing a 'nil' value will effectively delete the key from state, therefore we pass null character as value
-	value := []byte{0x00}
-	stub.PutState(colorNameIndexKey, value)
 
-	// ==== Marble saved and indexed. Return success ====
-	fmt.Println("- end init marble")
-	return shim.Success(nil)
+	// ==== Marble saved and indexed ====
+	fmt.Println("- end create marble " + marble.Name)
+	return nil
 }
 
 // ===============================================
 // readMarble - read a marble from chaincode state
 // ===============================================
 func (t *SimpleChaincode) readMarble(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	var name, jsonResp string
+	var name string
 	var err error
 
 	if len(args) != 1 {
-		return shim.Error("Incorrect number of arguments. Expecting name of the marble to query")
+		return errorWithCode(codeInvalidArgument, "Incorrect number of arguments. Expecting name of the marble to query")
 	}
 
 	name = args[0]
-	valAsbytes, err := stub.GetState(name) //get the marble from chaincode state
+	marble, err := getMarble(stub, name) //get the marble from chaincode state
 	if err != nil {
-		jsonResp = "{\"Error\":\"Failed to get state for " + name + "\"}"
-		return shim.Error(jsonResp)
-	} else if valAsbytes == nil {
-		jsonResp = "{\"Error\":\"Marble does not exist: " + name + "\"}"
-		return shim.Error(jsonResp)
+		return errorWithCode(codeInternal, "Failed to get state for " + name)
+	} else if marble == nil {
+		return errorWithCode(codeNotFound, "Marble does not exist: " + name)
 	}
 
+	valAsbytes, err := json.Marshal(marble)
+	if err != nil {
+		return errorResponse(err)
+	}
 	return shim.Success(valAsbytes)
 }
 
+// ===============================================
+// getMarble - read a marble from chaincode state and upgrade it to the current layout.
+// Returns nil if the marble does not exist.
+// ===============================================
+func getMarble(stub shim.ChaincodeStubInterface, name string) (*marble, error) {
+	marbleAsBytes, err := stub.GetState(name)
+	if err != nil {
+		return nil, errors.New("Failed to get marble: " + err.Error())
+	} else if marbleAsBytes == nil {
+		return nil, nil
+	}
+
+	m := marble{}
+	err = json.Unmarshal(marbleAsBytes, &m)
+	if err != nil {
+		return nil, errors.New("Failed to decode JSON of: " + name)
+	}
+	upgradeMarble(&m)
+	return &m, nil
+}
+
+// ===============================================
+// putMarble - write a marble to chaincode state in the current layout
+// ===============================================
+func putMarble(stub shim.ChaincodeStubInterface, m *marble) error {
+	m.SchemaVersion = marbleSchemaVersion
+	marbleJSONasBytes, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(m.Name, marbleJSONasBytes)
+}
+
+// ===============================================
+// upgradeMarble - bring a marble document read from state up to marbleSchemaVersion,
+// one layout version at a time
+// ===============================================
+func upgradeMarble(m *marble) {
+	if m.SchemaVersion < 1 {
+		// documents written before versioning have no attributes and may carry mixed-case owners
+		m.Owner = strings.ToLower(m.Owner)
+		m.SchemaVersion = 1
+	}
+	if m.SchemaVersion < 2 {
+		// marbles minted before custodian attestation existed stay tradable
+		m.Status = marbleStatusActive
+		m.SchemaVersion = 2
+	}
+}
+
 // ==================================================
 // delete - remove a marble key/value pair from state
 // ==================================================
 func (t *SimpleChaincode) delete(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	var jsonResp string
-	var marbleJSON marble
 	if len(args) != 1 {
-		return shim.Error("Incorrect number of arguments. Expecting 1")
+		return errorWithCode(codeInvalidArgument, "Incorrect number of arguments. Expecting 1")
 	}
 	marbleName := args[0]
 
 	// to maintain the color~name index, we need to read the marble first and get its color
-	valAsbytes, err := stub.GetState(marbleName) //get the marble from chaincode state
+	marbleJSON, err := getMarble(stub, marbleName) //get the marble from chaincode state
 	if err != nil {
-		jsonResp = "{\"Error\":\"Failed to get state for " + marbleName + "\"}"
-		return shim.Error(jsonResp)
-	} else if valAsbytes == nil {
-		jsonResp = "{\"Error\":\"Marble does not exist: " + marbleName + "\"}"
-		return shim.Error(jsonResp)
+		return errorResponse(err)
+	} else if marbleJSON == nil {
+		return errorWithCode(codeNotFound, "Marble does not exist: " + marbleName)
+	} else if marbleJSON.Status != marbleStatusActive {
+		// locked marbles and tombstones of redeemed marbles are kept
+		return errorWithCode(codeFailedPrecondition, "Marble " + marbleName + " cannot be deleted, status: " + marbleJSON.Status)
 	}
-
-	err = json.Unmarshal([]byte(valAsbytes), &marbleJSON)
-	if err != nil {
-		jsonResp = "{\"Error\":\"Failed to decode JSON of: " + marbleName + "\"}"
-		return shim.Error(jsonResp)
+	if marbleJSON.Physical != nil && marbleJSON.Physical.TagHash != "" {
+		// the tag~name entry must outlive the marble so the tag can never be minted again
+		return errorWithCode(codeFailedPrecondition, "Marble " + marbleName + " is bound to a physical tag and cannot be deleted, redeem it instead")
 	}
 
 	err = stub.DelState(marbleName) //remove the marble from chaincode state
@@ -324,14 +593,7 @@ func (t *SimpleChaincode) delete(stub shim.ChaincodeStubInterface, args []string
 	}
 
 	// maintain the index
-	indexName := "color~name"
-	colorNameIndexKey, err := stub.CreateCompositeKey(indexName, []string{marbleJSON.Color, marbleJSON.Name})
-	if err != nil {
-		return shim.Error(err.Error())
-	}
-
-	//  Delete index entry to state.
-	err = stub.DelState(colorNameIndexKey)
+	err = delColorIndex(stub, marbleJSON)
 	if err != nil {
 		return shim.Error("Failed to delete state:" + err.Error())
 	}
@@ -346,37 +608,54 @@ func (t *SimpleChaincode) transferMarble(stub shim.ChaincodeStubInterface, args
 	//   0       1
 	// "name", "bob"
 	if len(args) < 2 {
-		return shim.Error("Incorrect number of arguments. Expecting 2")
+		return errorWithCode(codeInvalidArgument, "Incorrect number of arguments. Expecting 2")
 	}
 
 	marbleName := args[0]
 	newOwner := strings.ToLower(args[1])
 	fmt.Println("- start transferMarble ", marbleName, newOwner)
-
-	marbleAsBytes, err := stub.GetState(marbleName)
+	marbleToTransfer, previousOwner, err := prepareTransfer(stub, marbleName, newOwner)
 	if err != nil {
-		return shim.Error("Failed to get marble:" + err.Error())
-	} else if marbleAsBytes == nil {
-		return shim.Error("Marble does not exist")
+		return errorResponse(err)
 	}
 
-	marbleToTransfer := marble{}
-	err = json.Unmarshal(marbleAsBytes, &marbleToTransfer) //unmarshal it aka JSON.parse()
+	err = putMarble(stub, marbleToTransfer) //rewrite the marble
 	if err != nil {
-		return shim.Error(err.Error())
+		return errorResponse(err)
 	}
-	marbleToTransfer.Owner = newOwner //change the owner
-
-	marbleJSONasBytes, _ := json.Marshal(marbleToTransfer)
-	err = stub.PutState(marbleName, marbleJSONasBytes) //rewrite the marble
+	err = recordTransfer(stub, marbleToTransfer, previousOwner)
 	if err != nil {
-		return shim.Error(err.Error())
+		return errorResponse(err)
 	}
 
 	fmt.Println("- end transferMarble (success)")
 	return shim.Success(nil)
 }
 
+// ===========================================================
+// prepareTransfer - check that a marble can go to newOwner and change its owner. The caller writes the marble.
+// Returns the marble and its previous owner.
+// ===========================================================
+func prepareTransfer(stub shim.ChaincodeStubInterface, marbleName string, newOwner string) (*marble, string, error) {
+	err := requireUser(stub, newOwner)
+	if err != nil {
+		return nil, "", err
+	}
+
+	marbleToTransfer, err := getMarble(stub, marbleName)
+	if err != nil {
+		return nil, "", err
+	} else if marbleToTransfer == nil {
+		return nil, "", newError(codeNotFound, "Marble does not exist: " + marbleName)
+	} else if marbleToTransfer.Status != marbleStatusActive {
+		return nil, "", newError(codeFailedPrecondition, "Marble " + marbleName + " is not tradable, status: " + marbleToTransfer.Status)
+	}
+	previousOwner := marbleToTransfer.Owner
+	marbleToTransfer.Owner = newOwner //change the owner
+	marbleToTransfer.Settlement = ""
+	return marbleToTransfer, previousOwner, nil
+}
+
 // ===========================================================================================
 // getMarblesByRange performs a range query based on the start and end keys provided.
 
@@ -390,16 +669,37 @@ func (t *SimpleChaincode) transferMarble(stub shim.ChaincodeStubInterface, args
 // ===========================================================================================
 func (t *SimpleChaincode) getMarblesByRange(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
-	if len(args) < 2 {
-		return shim.Error("Incorrect number of arguments. Expecting 2")
+	//   0          1          2       3
+	// "marble1", "marble5", ["10", ["bookmark"]]
+	if len(args) < 2 || len(args) > 4 {
+		return errorWithCode(codeInvalidArgument, "Incorrect number of arguments. Expecting 2 to 4")
 	}
 
 	startKey := args[0]
 	endKey := args[1]
 
+	if len(args) > 2 {
+		pageSize, bookmark, err := parsePageArgs(args[2:])
+		if err != nil {
+			return errorResponse(err)
+		}
+		resultsIterator, responseMetadata, err := stub.GetStateByRangeWithPagination(startKey, endKey, pageSize, bookmark)
+		if err != nil {
+			return errorResponse(err)
+		}
+		defer resultsIterator.Close()
+
+		pageAsBytes, err := constructPaginatedResult(resultsIterator, responseMetadata)
+		if err != nil {
+			return errorResponse(err)
+		}
+		fmt.Printf("- getMarblesByRange page:\n%s\n", string(pageAsBytes))
+		return shim.Success(pageAsBytes)
+	}
+
 	resultsIterator, err := stub.GetStateByRange(startKey, endKey)
 	if err != nil {
-		return shim.Error(err.Error())
+		return errorResponse(err)
 	}
 	defer resultsIterator.Close()
 
@@ -411,7 +711,7 @@ func (t *SimpleChaincode) getMarblesByRange(stub shim.ChaincodeStubInterface, ar
 	for resultsIterator.HasNext() {
 		queryResponse, err := resultsIterator.Next()
 		if err != nil {
-			return shim.Error(err.Error())
+			return errorResponse(err)
 		}
 		// Add a comma before array members, suppress it for the first array member
 		if bArrayMemberAlreadyWritten == true {
@@ -448,47 +748,20 @@ func (t *SimpleChaincode) transferMarblesBasedOnColor(stub shim.ChaincodeStubInt
 	//   0       1
 	// "color", "bob"
 	if len(args) < 2 {
-		return shim.Error("Incorrect number of arguments. Expecting 2")
+		return errorWithCode(codeInvalidArgument, "Incorrect number of arguments. Expecting 2")
 	}
 
-	color := args[0]
+	color := strings.ToLower(args[0])
 	newOwner := strings.ToLower(args[1])
 	fmt.Println("- start transferMarblesBasedOnColor ", color, newOwner)
 
-	// Query the color~name index by color
-	// This will execute a key range query on all keys starting with 'color'
-	coloredMarbleResultsIterator, err := stub.GetStateByPartialCompositeKey("color~name", []string{color})
+	// Query the color~name index by color and transfer every active marble found,
+	// see transferMarblesByFilter for the other filters
+	result, err := transferSelected(stub, marbleFilter{Color: color}, newOwner, false)
 	if err != nil {
-		return shim.Error(err.Error())
-	}
-	defer coloredMarbleResultsIterator.Close()
-
-	// Iterate through result set and for each marble found, transfer to newOwner
-	var i int
-	for i = 0; coloredMarbleResultsIterator.HasNext(); i++ {
-		// Note that we don't get the value (2nd return variable), we'll just get the marble name from the composite key
-		responseRange, err := coloredMarbleResultsIterator.Next()
-		if err != nil {
-			return shim.Error(err.Error())
-		}
-
-		// get the color and name from color~name composite key
-		objectType, compositeKeyParts, err := stub.SplitCompositeKey(responseRange.Key)
-		if err != nil {
-			return shim.Error(err.Error())
-		}
-		returnedColor := compositeKeyParts[0]
-		returnedMarbleName := compositeKeyParts[1]
-		fmt.Printf("- found a marble from index:%s color:%s name:%s\n", objectType, returnedColor, returnedMarbleName)
-
-		// Now call the transfer function for the found marble.
-		// Re-use the same function that is used to transfer individual marbles
-		response := t.transferMarble(stub, []string{returnedMarbleName, newOwner})
-		// if the transfer failed break out of loop and return error
-		if response.Status != shim.OK {
-			return shim.Error("Transfer failed: " + response.Message)
-		}
+		return errorResponse(err)
 	}
+	i := result.Count
 
 	responsePayload := fmt.Sprintf("Transferred %d %s marbles to %s", i, color, newOwner)
 	fmt.Println("- end transferMarblesBasedOnColor: " + responsePayload)
@@ -516,19 +789,31 @@ func (t *SimpleChaincode) transferMarblesBasedOnColor(stub shim.ChaincodeStubInt
 // =========================================================================================
 func (t *SimpleChaincode) queryMarblesByOwner(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
-	//   0
-	// "bob"
-	if len(args) < 1 {
-		return shim.Error("Incorrect number of arguments. Expecting 1")
+	//   0       1       2
+	// "bob", ["10", ["bookmark"]]
+	if len(args) < 1 || len(args) > 3 {
+		return errorWithCode(codeInvalidArgument, "Incorrect number of arguments. Expecting 1 to 3")
 	}
 
 	owner := strings.ToLower(args[0])
 
 	queryString := fmt.Sprintf("{\"selector\":{\"docType\":\"marble\",\"owner\":\"%s\"}}", owner)
 
+	if len(args) > 1 {
+		pageSize, bookmark, err := parsePageArgs(args[1:])
+		if err != nil {
+			return errorResponse(err)
+		}
+		pageAsBytes, err := getQueryResultForQueryStringWithPagination(stub, queryString, pageSize, bookmark)
+		if err != nil {
+			return errorResponse(err)
+		}
+		return shim.Success(pageAsBytes)
+	}
+
 	queryResults, err := getQueryResultForQueryString(stub, queryString)
 	if err != nil {
-		return shim.Error(err.Error())
+		return errorResponse(err)
 	}
 	return shim.Success(queryResults)
 }
@@ -542,17 +827,29 @@ func (t *SimpleChaincode) queryMarblesByOwner(stub shim.ChaincodeStubInterface,
 // =========================================================================================
 func (t *SimpleChaincode) queryMarbles(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
-	//   0
-	// "queryString"
-	if len(args) < 1 {
-		return shim.Error("Incorrect number of arguments. Expecting 1")
+	//   0               1       2
+	// "queryString", ["10", ["bookmark"]]
+	if len(args) < 1 || len(args) > 3 {
+		return errorWithCode(codeInvalidArgument, "Incorrect number of arguments. Expecting 1 to 3")
 	}
 
 	queryString := args[0]
 
+	if len(args) > 1 {
+		pageSize, bookmark, err := parsePageArgs(args[1:])
+		if err != nil {
+			return errorResponse(err)
+		}
+		pageAsBytes, err := getQueryResultForQueryStringWithPagination(stub, queryString, pageSize, bookmark)
+		if err != nil {
+			return errorResponse(err)
+		}
+		return shim.Success(pageAsBytes)
+	}
+
 	queryResults, err := getQueryResultForQueryString(stub, queryString)
 	if err != nil {
-		return shim.Error(err.Error())
+		return errorResponse(err)
 	}
 	return shim.Success(queryResults)
 }
@@ -603,69 +900,86 @@ func getQueryResultForQueryString(stub shim.ChaincodeStubInterface, queryString
 	return buffer.Bytes(), nil
 }
 
-func (t *SimpleChaincode) getHistoryForMarble(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-
-	if len(args) < 1 {
-		return shim.Error("Incorrect number of arguments. Expecting 1")
-	}
-
-	marbleName := args[0]
+// ===== Pagination ========================================================================
+// Range and rich queries take an optional page size and bookmark. When a page size is given,
+// the result is an envelope holding the page of records, the bookmark of the next page and the
+// number of records fetched. Pass the returned bookmark to get the next page, "" for the first one.
+// Paginated queries are only allowed in read-only (query) transactions.
+// =========================================================================================
+type queryRecord struct {
+	Key    string          `json:"Key"`
+	Record json.RawMessage `json:"Record"`
+}
 
-	fmt.Printf("- start getHistoryForMarble: %s\n", marbleName)
+type paginatedQueryResult struct {
+	Records             []queryRecord `json:"records"`
+	Bookmark            string        `json:"bookmark"`
+	FetchedRecordsCount int32         `json:"fetchedRecordsCount"`
+}
 
-	resultsIterator, err := stub.GetHistoryForKey(marbleName)
-	if err != nil {
-		return shim.Error(err.Error())
+// =========================================================================================
+// parsePageArgs parses the trailing [pageSize, [bookmark]] arguments of a query
+// =========================================================================================
+func parsePageArgs(args []string) (int32, string, error) {
+	pageSize, err := strconv.ParseInt(args[0], 10, 32)
+	if err != nil || pageSize <= 0 {
+		return 0, "", newError(codeInvalidArgument, "Page size must be a positive numeric string")
 	}
-	defer resultsIterator.Close()
-
-	// buffer is a JSON array containing historic values for the marble
-	var buffer bytes.Buffer
-	buffer.WriteString("[")
+	bookmark := ""
+	if len(args) > 1 {
+		bookmark = args[1]
+	}
+	return int32(pageSize), bookmark, nil
+}
 
-	bArrayMemberAlreadyWritten := false
+// =========================================================================================
+// constructPaginatedResult builds the page envelope from a paginated iterator
+// =========================================================================================
+func constructPaginatedResult(resultsIterator shim.StateQueryIteratorInterface, responseMetadata *pb.QueryResponseMetadata) ([]byte, error) {
+	page := paginatedQueryResult{Records: []queryRecord{}}
 	for resultsIterator.HasNext() {
-		response, err := resultsIterator.Next()
+		queryResponse, err := resultsIterator.Next()
 		if err != nil {
-			return shim.Error(err.Error())
-		}
-		// Add a comma before array members, suppress it for the first array member
-		if bArrayMemberAlreadyWritten == true {
-			buffer.WriteString(",")
+			return nil, err
 		}
-		buffer.WriteString("{\"TxId\":")
-		buffer.WriteString("\"")
-		buffer.WriteString(response.TxId)
-		buffer.WriteString("\"")
-
-		buffer.WriteString(", \"Value\":")
-		// if it was a delete operation on given key, then we need to set the
-		//corresponding value null. Else, we will write the response.Value
-		//as-is (as the Value itself a JSON marble)
-		if response.IsDelete {
-			buffer.WriteString("null")
-		} else {
-			buffer.WriteString(string(response.Value))
+		record := json.RawMessage(queryResponse.Value)
+		if !json.Valid(queryResponse.Value) {
+			// not a JSON document, e.g. an index entry, return it as a string
+			record, err = json.Marshal(string(queryResponse.Value))
+			if err != nil {
+				return nil, err
+			}
 		}
+		page.Records = append(page.Records, queryRecord{queryResponse.Key, record})
+	}
+	if responseMetadata != nil {
+		page.Bookmark = responseMetadata.Bookmark
+		page.FetchedRecordsCount = responseMetadata.FetchedRecordsCount
+	}
+	return json.Marshal(page)
+}
 
-		buffer.WriteString(", \"Timestamp\":")
-		buffer.WriteString("\"")
-		buffer.WriteString(time.Unix(response.Timestamp.Seconds, int64(response.Timestamp.Nanos)).String())
-		buffer.WriteString("\"")
+// =========================================================================================
+// getQueryResultForQueryStringWithPagination executes the passed in query string and
+// returns one page of results
+// =========================================================================================
+func getQueryResultForQueryStringWithPagination(stub shim.ChaincodeStubInterface, queryString string, pageSize int32, bookmark string) ([]byte, error) {
 
-		buffer.WriteString(", \"IsDelete\":")
-		buffer.WriteString("\"")
-		buffer.WriteString(strconv.FormatBool(response.IsDelete))
-		buffer.WriteString("\"")
+	fmt.Printf("- getQueryResultForQueryStringWithPagination queryString:\n%s\n", queryString)
 
-		buffer.WriteString("}")
-		bArrayMemberAlreadyWritten = true
+	resultsIterator, responseMetadata, err := stub.GetQueryResultWithPagination(queryString, pageSize, bookmark)
+	if err != nil {
+		return nil, err
 	}
-	buffer.WriteString("]")
+	defer resultsIterator.Close()
 
-	fmt.Printf("- getHistoryForMarble returning:\n%s\n", buffer.String())
+	pageAsBytes, err := constructPaginatedResult(resultsIterator, responseMetadata)
+	if err != nil {
+		return nil, err
+	}
 
-	return shim.Success(buffer.Bytes())
+	fmt.Printf("- getQueryResultForQueryStringWithPagination queryResult:\n%s\n", string(pageAsBytes))
+	return pageAsBytes, nil
 }
 
 //=================================================================================
@@ -679,43 +993,71 @@ func (t *SimpleChaincode) getHistoryForMarble(stub shim.ChaincodeStubInterface,
 func (t *SimpleChaincode) initOpenTrade(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	
 	if len(args) < 5 {
-		return shim.Error("Incorrect number of arguments. Expecting 5")
+		return errorWithCode(codeInvalidArgument, "Incorrect number of arguments. Expecting 5")
 	}
 	
 	size1, err := strconv.Atoi(args[2])
+	if err != nil {
+		return errorWithCode(codeInvalidArgument, "3rd argument must be a numeric string")
+	}
 	size2, err := strconv.Atoi(args[4])
+	if err != nil {
+		return errorWithCode(codeInvalidArgument, "5th argument must be a numeric string")
+	}
 	
 	open := AnOpenTrade{}
 	open.ObjectType = "openTrade"
-	open.Timestamp = makeTimestamp()
-	open.User = args[0]
+	open.Timestamp, err = txTimestamp(stub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	open.User = strings.ToLower(args[0])
 	open.Want.Color = args[1]
 	open.Want.Size =  size1
 	open.Willing.Color = args[3]
 	open.Willing.Size =  size2
+	err = requireUser(stub, open.User)
+	if err != nil {
+		return errorResponse(err)
+	}
+	err = requireUserOrAdmin(stub, open.User, "initOpenTrade")
+	if err != nil {
+		return errorResponse(err)
+	}
+	open.Credits, err = parseTradeCredits(stub, open.User, args, 5)
+	if err != nil {
+		return errorResponse(err)
+	}
 
 	openTradeKey := "openTrade" + strconv.FormatInt(open.Timestamp, 10)
 
-	// ==== Check if opentrade already exists ====
+	// ==== If an opentrade already exists, move to the next free second ====
 	openTradeAsBytes, err := stub.GetState(openTradeKey)
+	for err == nil && openTradeAsBytes != nil {
+		fmt.Println("This opentrade already exists: " + openTradeKey)
+		open.Timestamp++
+		openTradeKey = "openTrade" + strconv.FormatInt(open.Timestamp, 10)
+		openTradeAsBytes, err = stub.GetState(openTradeKey)
+	}
 	if err != nil {
 		return shim.Error("Failed to get opentrade: " + err.Error())
-	} else if openTradeAsBytes != nil {
-		fmt.Println("This opentrade already exists: " )
-		return shim.Error("This opentrade already exists: " )
 	}
 
 	// ==== Create AnOpenTrade object and marshal to JSON ====
 
 	openTradeJSONasBytes, err := json.Marshal(open)
 	if err != nil {
-		return shim.Error(err.Error())
+		return errorResponse(err)
 	}
 
 	// === Save marble to state ===
 	err = stub.PutState(openTradeKey, openTradeJSONasBytes)
 	if err != nil {
-		return shim.Error(err.Error())
+		return errorResponse(err)
+	}
+	err = recordTradeActivity(stub, activityTradeOpened, open, "")
+	if err != nil {
+		return errorResponse(err)
 	}
 
 	// ==== Marble saved and indexed. Return success ====
@@ -726,16 +1068,37 @@ func (t *SimpleChaincode) initOpenTrade(stub shim.ChaincodeStubInterface, args [
 
 func (t *SimpleChaincode) getOpenTradesByRange(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	
-		if len(args) < 2 {
-			return shim.Error("Incorrect number of arguments. Expecting 2")
+		//   0            1            2       3
+		// "openTrade1", "openTrade9", ["10", ["bookmark"]]
+		if len(args) < 2 || len(args) > 4 {
+			return errorWithCode(codeInvalidArgument, "Incorrect number of arguments. Expecting 2 to 4")
 		}
 	
 		startKey := args[0]
 		endKey := args[1]
+
+		if len(args) > 2 {
+			pageSize, bookmark, err := parsePageArgs(args[2:])
+			if err != nil {
+				return errorResponse(err)
+			}
+			resultsIterator, responseMetadata, err := stub.GetStateByRangeWithPagination(startKey, endKey, pageSize, bookmark)
+			if err != nil {
+				return errorResponse(err)
+			}
+			defer resultsIterator.Close()
+
+			pageAsBytes, err := constructPaginatedResult(resultsIterator, responseMetadata)
+			if err != nil {
+				return errorResponse(err)
+			}
+			fmt.Printf("- getOpenTradesByRange page:\n%s\n", string(pageAsBytes))
+			return shim.Success(pageAsBytes)
+		}
 	
 		resultsIterator, err := stub.GetStateByRange(startKey, endKey)
 		if err != nil {
-			return shim.Error(err.Error())
+			return errorResponse(err)
 		}
 		defer resultsIterator.Close()
 	
@@ -747,7 +1110,7 @@ func (t *SimpleChaincode) getOpenTradesByRange(stub shim.ChaincodeStubInterface,
 		for resultsIterator.HasNext() {
 			queryResponse, err := resultsIterator.Next()
 			if err != nil {
-				return shim.Error(err.Error())
+				return errorResponse(err)
 			}
 			// Add a comma before array members, suppress it for the first array member
 			if bArrayMemberAlreadyWritten == true {
@@ -774,64 +1137,111 @@ func (t *SimpleChaincode) getOpenTradesByRange(stub shim.ChaincodeStubInterface,
 func (t *SimpleChaincode) openTrade(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	
 		if len(args) < 5 {
-			return shim.Error("Incorrect number of arguments. Expecting 5")
+			return errorWithCode(codeInvalidArgument, "Incorrect number of arguments. Expecting 5")
 		}
 		
 		size1, err := strconv.Atoi(args[2])
+		if err != nil {
+			return errorWithCode(codeInvalidArgument, "3rd argument must be a numeric string")
+		}
 		size2, err := strconv.Atoi(args[4])
+		if err != nil {
+			return errorWithCode(codeInvalidArgument, "5th argument must be a numeric string")
+		}
 		
+		now, err := txTimestamp(stub)
+		if err != nil {
+			return errorResponse(err)
+		}
 		open := AnOpenTrade{}
 		open.ObjectType = "openTrade"
-		open.Timestamp = makeTimestamp()
-		open.User = args[0]
+		open.User = strings.ToLower(args[0])
 		open.Want.Color = args[1]
 		open.Want.Size =  size1
 		open.Willing.Color = args[3]
 		open.Willing.Size =  size2
+		err = requireUser(stub, open.User)
+		if err != nil {
+			return errorResponse(err)
+		}
+		err = requireUserOrAdmin(stub, open.User, "openTrade")
+		if err != nil {
+			return errorResponse(err)
+		}
+		open.Credits, err = parseTradeCredits(stub, open.User, args, 5)
+		if err != nil {
+			return errorResponse(err)
+		}
 		
 		//get the open trade struct
 		tradesAsBytes, err := stub.GetState(openTradesStr)
 		if err != nil {
-			return shim.Error(err.Error())
+			return errorResponse(err)
 		}
 		var trades AllOpenTrades
 		json.Unmarshal(tradesAsBytes, &trades)
+		open.Timestamp = uniqueTradeTimestamp(trades.OpenTrades, now)						//the trade ID, the same on every peer
 
 		fmt.Printf("- Finished getting current open trades \n")
-		fmt.Printf("- Adding new trade to opentrade \n")
+		limits, err := getTradeLimits(stub)
+		if err != nil {
+			return errorResponse(err)
+		}
 		
-		trades.OpenTrades = append(trades.OpenTrades, open)						//append to open trades
-		fmt.Println("! appended open to trades")
+		//an identical open trade of the same user is rejected or takes the new credits
+		activityKind := activityTradeOpened
+		if i := findDuplicateTrade(trades.OpenTrades, open, 0); i >= 0 {
+			if limits.Duplicates != duplicateMerge {
+				return errorResponse(duplicateTradeError(trades.OpenTrades[i]))
+			}
+			fmt.Printf("- Merging new trade into open trade %d \n", trades.OpenTrades[i].Timestamp)
+			trades.OpenTrades[i].Credits = open.Credits
+			open = trades.OpenTrades[i]
+			activityKind = activityTradeAmended
+		} else {
+			err = checkOpenTradeLimit(limits, trades.OpenTrades, open.User)
+			if err != nil {
+				return errorResponse(err)
+			}
+			fmt.Printf("- Adding new trade to opentrade \n")
+			trades.OpenTrades = append(trades.OpenTrades, open)						//append to open trades
+			fmt.Println("! appended open to trades")
+		}
 		tradeJSONasBytes, _ := json.Marshal(trades)
 		err = stub.PutState(openTradesStr, tradeJSONasBytes)								//rewrite open orders
 		if err != nil {
-			return shim.Error(err.Error())
+			return errorResponse(err)
+		}
+		err = recordTradeActivity(stub, activityKind, open, "")
+		if err != nil {
+			return errorResponse(err)
 		}
 		fmt.Println("- end open trade")
-		return shim.Success(nil)
+		openAsBytes, _ := json.Marshal(open)
+		return shim.Success(openAsBytes)
 	}
 
 // ============================================================================================================================
-// makeTimestamp - create a timestamp in ms
+// txTimestamp - the transaction timestamp in seconds, identical on every endorsing peer
 // ============================================================================================================================
-func makeTimestamp() int64 {
-	return time.Now().UnixNano() / (int64(time.Second))
-    // return time.Now().UnixNano() / (int64(time.Millisecond)/int64(time.Nanosecond))
-}	
+func txTimestamp(stub shim.ChaincodeStubInterface) (int64, error) {
+	timestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return 0, errors.New("Failed to get transaction timestamp: " + err.Error())
+	}
+	return timestamp.Seconds, nil
+}
 
 // ===============================================
 // readOpenTrade - read a readOpenTrade from chaincode state
 // ===============================================
 func (t *SimpleChaincode) readOpenTrade(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	var jsonResp string
 
 	valAsbytes, err := stub.GetState(openTradesStr) //get the openTrades from chaincode state
 	if err != nil {
-		jsonResp = "{\"Error\":\"Failed to get state for " + openTradesStr + "\"}"
-		return shim.Error(jsonResp)
+		return errorWithCode(codeInternal, "Failed to get state for " + openTradesStr)
 	} else if valAsbytes == nil {
-		jsonResp = "{\"Error\":\"Marble does not exist: " + openTradesStr + "\"}"
-		return shim.Error(jsonResp)
+		return errorWithCode(codeNotFound, "opentrades does not exist: " + openTradesStr)
 	}
 	
 	var trades AllOpenTrades
@@ -846,19 +1256,19 @@ func (t *SimpleChaincode) readOpenTrade(stub shim.ChaincodeStubInterface, args [
 func (t *SimpleChaincode) removeOpenTrade(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
 	if len(args) != 1 {
-		return shim.Error("Incorrect number of arguments. Expecting timestamp of the open trade")
+		return errorWithCode(codeInvalidArgument, "Incorrect number of arguments. Expecting timestamp of the open trade")
 	}
 
 	fmt.Println("- start remove trade")
 	timestamp, err := strconv.ParseInt(args[0], 10, 64)
 	if err != nil {
-		return shim.Error("1st argument must be a numeric string")
+		return errorWithCode(codeInvalidArgument, "1st argument must be a numeric string")
 	}
 
 	//get the open trade struct
 	tradesAsBytes, err := stub.GetState(openTradesStr)
 	if err != nil {
-		return shim.Error("Failed to get opentrades")
+		return errorWithCode(codeInternal, "Failed to get opentrades")
 	}
 	var trades AllOpenTrades
 	json.Unmarshal(tradesAsBytes, &trades)		
@@ -867,19 +1277,96 @@ func (t *SimpleChaincode) removeOpenTrade(stub shim.ChaincodeStubInterface, args
 		//fmt.Println("looking at " + strconv.FormatInt(trades.OpenTrades[i].Timestamp, 10) + " for " + strconv.FormatInt(timestamp, 10))
 		if trades.OpenTrades[i].Timestamp == timestamp{
 			fmt.Println("found the trade");
+			removed := trades.OpenTrades[i]
+			err = requireUserOrAdmin(stub, removed.User, "removeOpenTrade")
+			if err != nil {
+				return errorResponse(err)
+			}
 			trades.OpenTrades = append(trades.OpenTrades[:i], trades.OpenTrades[i+1:]...)				//remove this trade
 			tradesAsBytes, _ := json.Marshal(trades)
 			err = stub.PutState(openTradesStr, tradesAsBytes)												//rewrite open orders
 			if err != nil {
-				return shim.Error(err.Error())
+				return errorResponse(err)
+			}
+			err = recordTradeActivity(stub, activityTradeCancelled, removed, "")
+			if err != nil {
+				return errorResponse(err)
 			}
-			break
+			err = updateReputation(stub, nil, removed.User, func(r *reputation) { r.Cancelled++ })
+			if err != nil {
+				return errorResponse(err)
+			}
+			fmt.Println("- end remove trade")
+			fmt.Println(trades.OpenTrades)
+			return shim.Success(nil)
 		}
 	}
-	
-	fmt.Println("- end remove trade")
-	fmt.Println(trades.OpenTrades)
-	return shim.Success(nil)
+	return errorWithCode(codeNotFound, "Open trade does not exist: " + args[0])
+}
+
+// ===============================================
+// amendOpenTrade - change what an open trade wants and is willing to trade, keeping its timestamp
+// ===============================================
+func (t *SimpleChaincode) amendOpenTrade(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0             1       2     3      4      5
+	// "1528000000", "red", "50", "blue", "35", ["10"]
+	if len(args) != 5 && len(args) != 6 {
+		return errorWithCode(codeInvalidArgument, "Incorrect number of arguments. Expecting 5 or 6")
+	}
+
+	fmt.Println("- start amend trade")
+	timestamp, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return errorWithCode(codeInvalidArgument, "1st argument must be a numeric string")
+	}
+	size1, err := strconv.Atoi(args[2])
+	if err != nil {
+		return errorWithCode(codeInvalidArgument, "3rd argument must be a numeric string")
+	}
+	size2, err := strconv.Atoi(args[4])
+	if err != nil {
+		return errorWithCode(codeInvalidArgument, "5th argument must be a numeric string")
+	}
+
+	//get the open trade struct
+	tradesAsBytes, err := stub.GetState(openTradesStr)
+	if err != nil {
+		return errorWithCode(codeInternal, "Failed to get opentrades")
+	}
+	var trades AllOpenTrades
+	json.Unmarshal(tradesAsBytes, &trades)
+
+	for i := range trades.OpenTrades {																	//look for the trade
+		if trades.OpenTrades[i].Timestamp != timestamp {
+			continue
+		}
+		err = requireUserOrAdmin(stub, trades.OpenTrades[i].User, "amendOpenTrade")
+		if err != nil {
+			return errorResponse(err)
+		}
+		trades.OpenTrades[i].Want = Description{args[1], size1}
+		trades.OpenTrades[i].Willing = Description{args[3], size2}
+		if j := findDuplicateTrade(trades.OpenTrades, trades.OpenTrades[i], timestamp); j >= 0 {		//amending never merges two open trades
+			return errorResponse(duplicateTradeError(trades.OpenTrades[j]))
+		}
+		trades.OpenTrades[i].Credits, err = parseTradeCredits(stub, trades.OpenTrades[i].User, args, 5)
+		if err != nil {
+			return errorResponse(err)
+		}
+		tradesAsBytes, _ := json.Marshal(trades)
+		err = stub.PutState(openTradesStr, tradesAsBytes)												//rewrite open orders
+		if err != nil {
+			return errorResponse(err)
+		}
+		err = recordTradeActivity(stub, activityTradeAmended, trades.OpenTrades[i], "")
+		if err != nil {
+			return errorResponse(err)
+		}
+		fmt.Println("- end amend trade")
+		return shim.Success(nil)
+	}
+	return errorWithCode(codeNotFound, "Open trade does not exist: " + args[0])
 }
 
 //====================================================================================
@@ -925,77 +1412,25 @@ func (t *SimpleChaincode) swapMarble(stub shim.ChaincodeStubInterface, args []st
 
 	//args = owner1, color1, size1, owner2, color2, size2 
 
-	var owner1 = args[0]
-	var color1 = args[1]
-	// var size1 = args[2]
-	var owner2 = args[3]
-	var color2 = args[4]
-	// var size2 = args[5]
-
 	if len(args) != 6 {
-		return shim.Error("Incorrect number of arguments. Expecting 6 args")
+		return errorWithCode(codeInvalidArgument, "Incorrect number of arguments. Expecting 6 args")
 	}
 
-	queryString1 := fmt.Sprintf("{\"selector\":{\"docType\":\"marble\",\"owner\":\"%s\"}}", owner1)
-	
-	queryString2 := fmt.Sprintf("{\"selector\":{\"docType\":\"marble\",\"owner\":\"%s\"}}", owner2)
-	
-	queryResults1, err := getQueryResultForQueryStringtoMap(stub, queryString1)
-	queryResults2, err := getQueryResultForQueryStringtoMap(stub, queryString2)
-	fmt.Printf("- swapMarble queryResults1:\n%s\n", queryResults1)
-	fmt.Println(queryResults1)
-	fmt.Println(queryResults2)
-
-	marble1Name := ""
-	marble2Name := ""
-	for k, v := range queryResults1 {
-		innermap, ok := v.(map[string]interface{})
-
-		if !ok {
-			panic("inner map is not a map!")
-		}
-		if (innermap["color"] == color1) {
-			fmt.Println("marble1 bingo............")
-			marble1Name = k
-	
-		}
-		fmt.Printf("key[%s] value[%s]\n", k, innermap)
-	}
-
-	for k, v := range queryResults2 {
-		innermap, ok := v.(map[string]interface{})
-
-		if !ok {
-			panic("inner map is not a map!")
-		}
-		if (innermap["color"] == color2) {
-			fmt.Println("marble2 bingo............")
-			marble2Name = k
-		}
-		fmt.Printf("key[%s] value[%s]\n", k, innermap)
+	legs, err := parseSwapLegs(args)
+	if err != nil {
+		return errorResponse(err)
 	}
-
-	if (marble1Name != "")  && (marble2Name != "") {
-		fmt.Println("- swapMarble : start swapping marbles")
-
-		response := t.transferMarble(stub, []string{marble1Name, owner2})
-
-		// if the transfer failed break out of loop and return error
-		if response.Status != shim.OK {
-			return shim.Error("Transfer failed: " + response.Message)
-		}
-		response = t.transferMarble(stub, []string{marble2Name, owner1})
-		// if the transfer failed break out of loop and return error
-		if response.Status != shim.OK {
-			return shim.Error("Transfer failed: " + response.Message)
-		}
-		fmt.Println("- swapMarble : finished swapping marbles")
+	settled, err := settleSwap(stub, newSettlementRun(), settlementSwap, 0, legs, nil)
+	if err != nil {
+		return errorResponse(err)
+	} else if settled == nil {
+		return shim.Success(nil)
 	}
+	settlementAsBytes, err := json.Marshal(settled)
 	if err != nil {
-		return shim.Error(err.Error())
+		return errorResponse(err)
 	}
-	return shim.Success([]byte("success"))
-
+	return shim.Success(settlementAsBytes)
 }
 
 // ===============================================
@@ -1006,102 +1441,25 @@ func (t *SimpleChaincode) swapMarbleTri(stub shim.ChaincodeStubInterface, args [
 	
 		//args = owner1, color1, size1, owner2, color2, size2 
 	
-		var owner1 = args[0]
-		var color1 = args[1]
-		// var size1 = args[2]
-		var owner2 = args[3]
-		var color2 = args[4]
-		// var size2 = args[5]
-		var owner3 = args[6]
-		var color3 = args[7]
-		// var size3 = args[8]
-
-	
 		if len(args) != 9 {
-			return shim.Error("Incorrect number of arguments. Expecting 9 args")
+			return errorWithCode(codeInvalidArgument, "Incorrect number of arguments. Expecting 9 args")
 		}
-	
-		queryString1 := fmt.Sprintf("{\"selector\":{\"docType\":\"marble\",\"owner\":\"%s\"}}", owner1)
-		
-		queryString2 := fmt.Sprintf("{\"selector\":{\"docType\":\"marble\",\"owner\":\"%s\"}}", owner2)
 
-		queryString3 := fmt.Sprintf("{\"selector\":{\"docType\":\"marble\",\"owner\":\"%s\"}}", owner3)
-		
-		queryResults1, err := getQueryResultForQueryStringtoMap(stub, queryString1)
-		queryResults2, err := getQueryResultForQueryStringtoMap(stub, queryString2)
-		queryResults3, err := getQueryResultForQueryStringtoMap(stub, queryString3)
-		fmt.Printf("- swapMarble queryResults1:\n%s\n", queryResults1)
-		fmt.Printf("- swapMarble queryResults2:\n%s\n", queryResults2)
-		fmt.Printf("- swapMarble queryResults3:\n%s\n", queryResults3)
-		marble1Name := ""
-		marble2Name := ""
-		marble3Name := ""
-		for k, v := range queryResults1 {
-			innermap, ok := v.(map[string]interface{})
-	
-			if !ok {
-				panic("inner map is not a map!")
-			}
-			if (innermap["color"] == color1) {
-				fmt.Println("marble1 bingo............")
-				marble1Name = k
-		
-			}
-			fmt.Printf("key[%s] value[%s]\n", k, innermap)
-		}
-	
-		for k, v := range queryResults2 {
-			innermap, ok := v.(map[string]interface{})
-	
-			if !ok {
-				panic("inner map is not a map!")
-			}
-			if (innermap["color"] == color2) {
-				fmt.Println("marble2 bingo............")
-				marble2Name = k
-			}
-			fmt.Printf("key[%s] value[%s]\n", k, innermap)
-		}
-		
-		for k, v := range queryResults3 {
-			innermap, ok := v.(map[string]interface{})
-	
-			if !ok {
-				panic("inner map is not a map!")
-			}
-			if (innermap["color"] == color3) {
-				fmt.Println("marble3 bingo............")
-				marble3Name = k
-			}
-			fmt.Printf("key[%s] value[%s]\n", k, innermap)
+		legs, err := parseSwapLegs(args)
+		if err != nil {
+			return errorResponse(err)
 		}
-
-		if (marble1Name != "")  && (marble2Name != "")  && (marble3Name != ""){
-			fmt.Println("- swapMarbleTri : start swapping marbles Tri")
-	
-			response := t.transferMarble(stub, []string{marble1Name, owner2})
-	
-			// if the transfer failed break out of loop and return error
-			if response.Status != shim.OK {
-				return shim.Error("Transfer failed: " + response.Message)
-			}
-			response = t.transferMarble(stub, []string{marble2Name, owner3})
-			// if the transfer failed break out of loop and return error
-			if response.Status != shim.OK {
-				return shim.Error("Transfer failed: " + response.Message)
-			}
-			response = t.transferMarble(stub, []string{marble3Name, owner1})
-			// if the transfer failed break out of loop and return error
-			if response.Status != shim.OK {
-				return shim.Error("Transfer failed: " + response.Message)
-			}
-			fmt.Println("- swapMarble : finished swapping marbles")
+		settled, err := settleSwap(stub, newSettlementRun(), settlementSwap, 0, legs, nil)
+		if err != nil {
+			return errorResponse(err)
+		} else if settled == nil {
+			return shim.Success(nil)
 		}
+		settlementAsBytes, err := json.Marshal(settled)
 		if err != nil {
-			return shim.Error(err.Error())
+			return errorResponse(err)
 		}
-		return shim.Success([]byte("success"))
-	
+		return shim.Success(settlementAsBytes)
 	}
 
 // ===============================================
@@ -1109,14 +1467,11 @@ func (t *SimpleChaincode) swapMarbleTri(stub shim.ChaincodeStubInterface, args [
 // ===============================================
 
 func (t *SimpleChaincode) matchTrade(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	var jsonResp string
 	valAsbytes, err := stub.GetState(openTradesStr) //get the marble from chaincode state
 	if err != nil {
-		jsonResp = "{\"Error\":\"Failed to get state for " + openTradesStr + "\"}"
-		return shim.Error(jsonResp)
+		return errorWithCode(codeInternal, "Failed to get state for " + openTradesStr)
 	} else if valAsbytes == nil {
-		jsonResp = "{\"Error\":\"opentrades does not exist: " + openTradesStr + "\"}"
-		return shim.Error(jsonResp)
+		return errorWithCode(codeNotFound, "opentrades does not exist: " + openTradesStr)
 	}
 	
 	var openTradesStruct AllOpenTrades
@@ -1124,12 +1479,33 @@ func (t *SimpleChaincode) matchTrade(stub shim.ChaincodeStubInterface, args []st
 	fmt.Println("matchTrade")
 	fmt.Println(openTradesStruct.OpenTrades)
 	openTrades := openTradesStruct.OpenTrades
+	selfTrade, err := getSelfTradePolicy(stub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	settled := 0 //sequence of the settlements of this run
+	run := newSettlementRun()
 	for i := 0; i < len(openTrades); i++ {
 		for j := i + 1; j < len(openTrades); j++ {
-			if reflect.DeepEqual(openTrades[i].Want, openTrades[j].Willing) && reflect.DeepEqual(openTrades[i].Willing, openTrades[j].Want) {
+			if reflect.DeepEqual(openTrades[i].Want, openTrades[j].Willing) && reflect.DeepEqual(openTrades[i].Willing, openTrades[j].Want) && creditsNet(openTrades[i], openTrades[j]) == 0 &&
+			selfTradeAllowed(selfTrade, openTrades[i], openTrades[j]) {
+				exhausted, err := run.exhausted(stub, matchLegs([]AnOpenTrade{openTrades[i], openTrades[j]}))
+				if err != nil {
+					return errorResponse(err)
+				} else if exhausted {
+					fmt.Println("- marbles already traded in this run, trades stay open")
+					continue
+				}
 				fmt.Println("swapMarbles")
 				// swapMarbles
-				t.swapMarble(stub, []string{openTrades[i].User, openTrades[i].Willing.Color, strconv.Itoa(openTrades[i].Willing.Size), openTrades[j].User, openTrades[j].Willing.Color, strconv.Itoa(openTrades[j].Willing.Size)})
+				matched, err := settleMatch(stub, run, settlementPair, settled, []AnOpenTrade{openTrades[i], openTrades[j]})
+				if err != nil {
+					return errorResponse(err)
+				} else if matched == nil {
+					fmt.Println("- not settled, trades stay open")
+					continue
+				}
+				settled++
 				fmt.Println(i)
 				fmt.Println(openTrades[i])
 				// delete openTrades after matching orders
@@ -1154,7 +1530,7 @@ func (t *SimpleChaincode) matchTrade(stub shim.ChaincodeStubInterface, args []st
 	tradesAsBytes, _ := json.Marshal(openTradesStruct)
 	err = stub.PutState(openTradesStr, tradesAsBytes)												//rewrite open orders
 	if err != nil {
-		return shim.Error(err.Error())
+		return errorResponse(err)
 	}
 
 
@@ -1163,6 +1539,59 @@ func (t *SimpleChaincode) matchTrade(stub shim.ChaincodeStubInterface, args []st
 }
 
 
+// ===============================================
+// openTradeFromMap - read an openTrade document of a rich query result, false if a field is missing or mistyped
+// ===============================================
+func openTradeFromMap(value interface{}) (AnOpenTrade, bool) {
+	open := AnOpenTrade{}
+	open.ObjectType = "openTrade"
+	innermap, ok := value.(map[string]interface{})
+	if !ok {
+		return open, false
+	}
+	timestamp, ok := innermap["timestamp"].(float64)							//JSON numbers decode as float64
+	if !ok {
+		return open, false
+	}
+	open.Timestamp = int64(timestamp)
+	open.User, ok = innermap["user"].(string)
+	if !ok {
+		return open, false
+	}
+	open.Want, ok = descriptionFromMap(innermap["want"])
+	if !ok {
+		return open, false
+	}
+	open.Willing, ok = descriptionFromMap(innermap["willing"])
+	if !ok {
+		return open, false
+	}
+	credits, _ := innermap["credits"].(float64)								//omitted when there are none
+	open.Credits = int64(credits)
+	return open, true
+}
+
+// ===============================================
+// descriptionFromMap - read the want or willing description of an openTrade document
+// ===============================================
+func descriptionFromMap(value interface{}) (Description, bool) {
+	description := Description{}
+	innermap, ok := value.(map[string]interface{})
+	if !ok {
+		return description, false
+	}
+	description.Color, ok = innermap["color"].(string)
+	if !ok {
+		return description, false
+	}
+	size, ok := innermap["size"].(float64)
+	if !ok {
+		return description, false
+	}
+	description.Size = int(size)
+	return description, true
+}
+
 // ===============================================
 // matchTrade2 - match trades from within openTrades in chaincode state, compatibale with AnOpenTrade as seperate states
 // ===============================================
@@ -1175,26 +1604,24 @@ func (t *SimpleChaincode) matchTrade2(stub shim.ChaincodeStubInterface, args []s
 		
 	queryResults1, err := getQueryResultForQueryStringtoMap(stub, queryString1)
 	if err != nil {
-		return shim.Error(err.Error())
+		return errorResponse(err)
 	}
 	fmt.Printf("- matchTrade2 queryResults1:\n%s\n", queryResults1)
 	fmt.Println(queryResults1)
 	// convert the queryResults in to a slice of AnOpenTrades
 
+	var keys []string
+	for key := range queryResults1 {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)																		//the same order on every peer
+
 	var openTrades []AnOpenTrade
-	for  _, value := range queryResults1 {
-		innermap, ok := value.(map[string]interface{})
+	for _, key := range keys {
+		open, ok := openTradeFromMap(queryResults1[key])
 		if !ok {
-			panic("inner map is not a map!")
+			return errorWithCode(codeInternal, "Open trade is not readable: " + key)
 		}
-		open := AnOpenTrade{}
-		open.ObjectType = "openTrade"
-		open.Timestamp = innermap["TimeStamp"].(int64)
-		open.User = innermap["User"].(string)
-		open.Want.Color = innermap["Want"].(map[string]interface{})["Color"].(string)
-		open.Want.Size =  innermap["Want"].(map[string]interface{})["Size"].(int)
-		open.Willing.Color = innermap["Willing"].(map[string]interface{})["Color"].(string)
-		open.Willing.Size =  innermap["Willing"].(map[string]interface{})["Size"].(int)
 		openTrades = append (openTrades, open )
 	}
 	fmt.Println("matchTrade2..................")
@@ -1204,12 +1631,33 @@ func (t *SimpleChaincode) matchTrade2(stub shim.ChaincodeStubInterface, args []s
 	// json.Unmarshal(valAsbytes, &openTradesStruct)
 	// fmt.Println(openTradesStruct.OpenTrades)
 	// openTrades := openTradesStruct.OpenTrades
+	selfTrade, err := getSelfTradePolicy(stub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	settled := 0 //sequence of the settlements of this run
+	run := newSettlementRun()
 	for i := 0; i < len(openTrades); i++ {
 		for j := i + 1; j < len(openTrades); j++ {
-			if reflect.DeepEqual(openTrades[i].Want, openTrades[j].Willing) && reflect.DeepEqual(openTrades[i].Willing, openTrades[j].Want) {
+			if reflect.DeepEqual(openTrades[i].Want, openTrades[j].Willing) && reflect.DeepEqual(openTrades[i].Willing, openTrades[j].Want) && creditsNet(openTrades[i], openTrades[j]) == 0 &&
+			selfTradeAllowed(selfTrade, openTrades[i], openTrades[j]) {
+				exhausted, err := run.exhausted(stub, matchLegs([]AnOpenTrade{openTrades[i], openTrades[j]}))
+				if err != nil {
+					return errorResponse(err)
+				} else if exhausted {
+					fmt.Println("- marbles already traded in this run, trades stay open")
+					continue
+				}
 				fmt.Println("swapMarbles")
 				// swapMarbles
-				t.swapMarble(stub, []string{openTrades[i].User, openTrades[i].Willing.Color, strconv.Itoa(openTrades[i].Willing.Size), openTrades[j].User, openTrades[j].Willing.Color, strconv.Itoa(openTrades[j].Willing.Size)})
+				matched, err := settleMatch(stub, run, settlementPair, settled, []AnOpenTrade{openTrades[i], openTrades[j]})
+				if err != nil {
+					return errorResponse(err)
+				} else if matched == nil {
+					fmt.Println("- not settled, trades stay open")
+					continue
+				}
+				settled++
 				fmt.Println(i)
 				fmt.Println(openTrades[i])
 				// delete openTrades after matching orders
@@ -1234,7 +1682,7 @@ func (t *SimpleChaincode) matchTrade2(stub shim.ChaincodeStubInterface, args []s
 	// tradesAsBytes, _ := json.Marshal(openTradesStruct)
 	// err = stub.PutState(openTradesStr, tradesAsBytes)												//rewrite open orders
 	// if err != nil {
-	// 	return shim.Error(err.Error())
+	// 	return errorResponse(err)
 	// }
 
 
@@ -1246,14 +1694,11 @@ func (t *SimpleChaincode) matchTrade2(stub shim.ChaincodeStubInterface, args []s
 // matchTriTrade - match trades from within openTrades in chaincode state, compatibale with AnOpenTrade as slice in AllOpenTrades
 // ===============================================
 func (t *SimpleChaincode) matchTriTrade(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	var jsonResp string
 	valAsbytes, err := stub.GetState(openTradesStr) //get the marble from chaincode state
 	if err != nil {
-		jsonResp = "{\"Error\":\"Failed to get state for " + openTradesStr + "\"}"
-		return shim.Error(jsonResp)
+		return errorWithCode(codeInternal, "Failed to get state for " + openTradesStr)
 	} else if valAsbytes == nil {
-		jsonResp = "{\"Error\":\"opentrades does not exist: " + openTradesStr + "\"}"
-		return shim.Error(jsonResp)
+		return errorWithCode(codeNotFound, "opentrades does not exist: " + openTradesStr)
 	}
 	
 	var openTradesStruct AllOpenTrades
@@ -1261,17 +1706,27 @@ func (t *SimpleChaincode) matchTriTrade(stub shim.ChaincodeStubInterface, args [
 	fmt.Println("matchTrade")
 	fmt.Println(openTradesStruct.OpenTrades)
 	openTrades := openTradesStruct.OpenTrades
+	selfTrade, err := getSelfTradePolicy(stub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	settled := 0 //sequence of the settlements of this run
+	run := newSettlementRun()
+nextTrade:
 	for i := 0; i < len(openTrades); i++ {
 		for j := i + 1; j < len(openTrades); j++ {
 			for k := j + 1; k < len(openTrades); k++{
 				fmt.Println("matchTriTrade : compare opentrades")
-				if (reflect.DeepEqual(openTrades[i].Want, openTrades[j].Willing) && reflect.DeepEqual(openTrades[j].Want, openTrades[k].Willing) && reflect.DeepEqual(openTrades[k].Want, openTrades[i].Willing)) ||
-				(reflect.DeepEqual(openTrades[i].Want, openTrades[k].Willing) && reflect.DeepEqual(openTrades[k].Want, openTrades[j].Willing) && reflect.DeepEqual(openTrades[j].Want, openTrades[i].Willing)){
+				if ((reflect.DeepEqual(openTrades[i].Want, openTrades[j].Willing) && reflect.DeepEqual(openTrades[j].Want, openTrades[k].Willing) && reflect.DeepEqual(openTrades[k].Want, openTrades[i].Willing)) ||
+				(reflect.DeepEqual(openTrades[i].Want, openTrades[k].Willing) && reflect.DeepEqual(openTrades[k].Want, openTrades[j].Willing) && reflect.DeepEqual(openTrades[j].Want, openTrades[i].Willing))) &&
+				creditsNet(openTrades[i], openTrades[j], openTrades[k]) == 0 && selfTradeAllowed(selfTrade, openTrades[i], openTrades[j], openTrades[k]) {
 					fmt.Println("matchTriTrade - swapMarbles")
+					var cycle []AnOpenTrade
 					// swapMarbles
 					if (reflect.DeepEqual(openTrades[i].Want, openTrades[j].Willing) && reflect.DeepEqual(openTrades[j].Want, openTrades[k].Willing) && reflect.DeepEqual(openTrades[k].Want, openTrades[i].Willing)){
 						fmt.Println("matchTriTrade - first case - swapMarbleTri")
-						t.swapMarbleTri(stub, []string{openTrades[i].User, openTrades[i].Willing.Color, strconv.Itoa(openTrades[i].Willing.Size), openTrades[j].User, openTrades[j].Willing.Color, strconv.Itoa(openTrades[j].Willing.Size), openTrades[k].User, openTrades[k].Willing.Color, strconv.Itoa(openTrades[k].Willing.Size)})
+						// k wants what i is willing to give: i gives to k, k to j, j to i
+						cycle = []AnOpenTrade{openTrades[i], openTrades[k], openTrades[j]}
 						// following doesnt work......
 						// t.swapMarble(stub, []string{openTrades[i].User, openTrades[i].Willing.Color, strconv.Itoa(openTrades[i].Willing.Size), openTrades[j].User, openTrades[j].Willing.Color, strconv.Itoa(openTrades[j].Willing.Size)})
 						// t.swapMarble(stub, []string{openTrades[j].User, openTrades[i].Willing.Color, strconv.Itoa(openTrades[i].Willing.Size), openTrades[k].User, openTrades[k].Willing.Color, strconv.Itoa(openTrades[k].Willing.Size)})
@@ -1279,7 +1734,8 @@ func (t *SimpleChaincode) matchTriTrade(stub shim.ChaincodeStubInterface, args [
 						
 					}else {
 						fmt.Println("matchTriTrade - second case - swapMarbleTri")
-						t.swapMarbleTri(stub, []string{openTrades[i].User, openTrades[i].Willing.Color, strconv.Itoa(openTrades[i].Willing.Size), openTrades[k].User, openTrades[k].Willing.Color, strconv.Itoa(openTrades[k].Willing.Size), openTrades[j].User, openTrades[j].Willing.Color, strconv.Itoa(openTrades[j].Willing.Size)})
+						// j wants what i is willing to give: i gives to j, j to k, k to i
+						cycle = []AnOpenTrade{openTrades[i], openTrades[j], openTrades[k]}
 						
 						// fmt.Println("matchTriTrade - second case - step 1")
 						// t.swapMarble(stub, []string{openTrades[i].User, openTrades[i].Willing.Color, strconv.Itoa(openTrades[i].Willing.Size), openTrades[k].User, openTrades[k].Willing.Color, strconv.Itoa(openTrades[k].Willing.Size)})
@@ -1292,6 +1748,21 @@ func (t *SimpleChaincode) matchTriTrade(stub shim.ChaincodeStubInterface, args [
 						// t.swapMarble(stub, []string{openTrades[k].User, openTrades[i].Willing.Color, strconv.Itoa(openTrades[i].Willing.Size), openTrades[j].User, openTrades[j].Willing.Color, strconv.Itoa(openTrades[j].Willing.Size)})
 						// fmt.Println(openTrades[i])
 					}
+					exhausted, err := run.exhausted(stub, matchLegs(cycle))
+					if err != nil {
+						return errorResponse(err)
+					} else if exhausted {
+						fmt.Println("matchTriTrade - marbles already traded in this run, trades stay open")
+						continue
+					}
+					matched, err := settleMatch(stub, run, settlementTriangle, settled, cycle)
+					if err != nil {
+						return errorResponse(err)
+					} else if matched == nil {
+						fmt.Println("matchTriTrade - not settled, trades stay open")
+						continue
+					}
+					settled++
 					// delete openTrades after matching orders
 					// delete from hyperledger blockchain
 					// t.removeOpenTrade(stub,[]string{strconv.FormatInt(openTrades[i].Timestamp, 10)})
@@ -1304,7 +1775,7 @@ func (t *SimpleChaincode) matchTriTrade(stub shim.ChaincodeStubInterface, args [
 					openTrades = append(openTrades[:i], openTrades[i+1:]...)
 					fmt.Println(openTrades)
 					i-- // redo index since the orignal has been deleted
-					break
+					continue nextTrade
 				}
 			}
 		}
@@ -1316,7 +1787,7 @@ func (t *SimpleChaincode) matchTriTrade(stub shim.ChaincodeStubInterface, args [
 	tradesAsBytes, _ := json.Marshal(openTradesStruct)
 	err = stub.PutState(openTradesStr, tradesAsBytes)												//rewrite open orders
 	if err != nil {
-		return shim.Error(err.Error())
+		return errorResponse(err)
 	}
 
 
@@ -1334,11 +1805,17 @@ func (t *SimpleChaincode) clearOpenTrades(stub shim.ChaincodeStubInterface, args
 	var trades AllOpenTrades
 	json.Unmarshal(valAsbytes, &trades)		
 
+	for _, cleared := range trades.OpenTrades {
+		err = recordTradeActivity(stub, activityTradeCancelled, cleared, "")
+		if err != nil {
+			return errorResponse(err)
+		}
+	}
 	trades.OpenTrades = []AnOpenTrade{} 		//remove all trades
 	tradesAsBytes, _ := json.Marshal(trades)
 	err = stub.PutState(openTradesStr, tradesAsBytes)												//rewrite open orders
 	if err != nil {
-		return shim.Error(err.Error())
+		return errorResponse(err)
 	}
-	return shim.Success([]byte("success"))
+	return shim.Success(nil)
 }
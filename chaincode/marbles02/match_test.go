@@ -0,0 +1,259 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// newMatchStub - a mock ledger holding the marbles and open trades, with their users registered
+func newMatchStub(t *testing.T, marbles []marble, trades []AnOpenTrade) *shim.MockStub {
+	stub := shim.NewMockStub("marbles", new(SimpleChaincode))
+	stub.MockTransactionStart("setup")
+	defer stub.MockTransactionEnd("setup")
+
+	handles := map[string]bool{}
+	for _, m := range marbles {
+		handles[m.Owner] = true
+	}
+	for _, trade := range trades {
+		handles[trade.User] = true
+	}
+	for handle := range handles {
+		if err := putUser(stub, &user{ObjectType: "user", Handle: handle}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := range marbles {
+		m := marbles[i]
+		m.ObjectType, m.Status = "marble", marbleStatusActive
+		if err := putMarble(stub, &m); err != nil {
+			t.Fatal(err)
+		}
+		if err := putColorIndex(stub, &m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tradesAsBytes, _ := json.Marshal(AllOpenTrades{trades})
+	if err := stub.PutState(openTradesStr, tradesAsBytes); err != nil {
+		t.Fatal(err)
+	}
+	return stub
+}
+
+// invokeInTx - call a chaincode function directly, bypassing the admin check of Invoke, in its own transaction
+func invokeInTx(t *testing.T, stub *shim.MockStub, txid string, fn func(shim.ChaincodeStubInterface, []string) pb.Response, args ...string) {
+	stub.MockTransactionStart(txid)
+	defer stub.MockTransactionEnd(txid)
+	if response := fn(stub, args); response.Status != shim.OK {
+		t.Fatalf("%s failed: %s", txid, response.Message)
+	}
+}
+
+func openTradeUsers(t *testing.T, stub *shim.MockStub) []string {
+	var trades AllOpenTrades
+	if err := json.Unmarshal(stub.State[openTradesStr], &trades); err != nil {
+		t.Fatal(err)
+	}
+	users := []string{}
+	for _, trade := range trades.OpenTrades {
+		users = append(users, trade.User)
+	}
+	return users
+}
+
+func ownerOf(t *testing.T, stub *shim.MockStub, name string) string {
+	m, err := getMarble(stub, name)
+	if err != nil || m == nil {
+		t.Fatalf("marble %s: %v", name, err)
+	}
+	return m.Owner
+}
+
+func settlementCount(stub *shim.MockStub) int {
+	resultsIterator, _ := stub.GetStateByPartialCompositeKey("settlement", []string{})
+	count := 0
+	for resultsIterator.HasNext() {
+		resultsIterator.Next()
+		count++
+	}
+	return count
+}
+
+func timedTrade(user string, timestamp int64, want string, willing string) AnOpenTrade {
+	return AnOpenTrade{"openTrade", user, timestamp, Description{want, 50}, Description{willing, 50}, 0}
+}
+
+func TestMatchTradeSettlesPair(t *testing.T) {
+	cc := new(SimpleChaincode)
+	stub := newMatchStub(t,
+		[]marble{{Name: "marble1", Color: "blue", Size: 50, Owner: "tom"}, {Name: "marble2", Color: "red", Size: 50, Owner: "jerry"}},
+		[]AnOpenTrade{timedTrade("tom", 1, "red", "blue"), timedTrade("jerry", 2, "blue", "red")})
+
+	invokeInTx(t, stub, "match", cc.matchTrade)
+
+	if owner := ownerOf(t, stub, "marble1"); owner != "jerry" {
+		t.Errorf("marble1 owned by %s, want jerry", owner)
+	}
+	if owner := ownerOf(t, stub, "marble2"); owner != "tom" {
+		t.Errorf("marble2 owned by %s, want tom", owner)
+	}
+	if users := openTradeUsers(t, stub); len(users) != 0 {
+		t.Errorf("open trades left for %v, want none", users)
+	}
+	if count := settlementCount(stub); count != 1 {
+		t.Errorf("%d settlements, want 1", count)
+	}
+}
+
+func TestMatchTradeLeavesTradesOpenWhenNotSettled(t *testing.T) {
+	cc := new(SimpleChaincode)
+	// jerry is willing to give a red marble he does not have
+	stub := newMatchStub(t,
+		[]marble{{Name: "marble1", Color: "blue", Size: 50, Owner: "tom"}},
+		[]AnOpenTrade{timedTrade("tom", 1, "red", "blue"), timedTrade("jerry", 2, "blue", "red")})
+
+	invokeInTx(t, stub, "match", cc.matchTrade)
+
+	if owner := ownerOf(t, stub, "marble1"); owner != "tom" {
+		t.Errorf("marble1 owned by %s, want tom", owner)
+	}
+	if users := openTradeUsers(t, stub); len(users) != 2 {
+		t.Errorf("open trades left for %v, want tom and jerry", users)
+	}
+	if count := settlementCount(stub); count != 0 {
+		t.Errorf("%d settlements, want none", count)
+	}
+	r, err := loadReputation(stub, "jerry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.FailedInventory != 1 {
+		t.Errorf("jerry failed %d matches for missing inventory, want 1", r.FailedInventory)
+	}
+}
+
+func TestMatchTradeGivesEachMarbleOncePerRun(t *testing.T) {
+	cc := new(SimpleChaincode)
+	// both of tom's trades give his only blue marble
+	stub := newMatchStub(t,
+		[]marble{{Name: "marble1", Color: "blue", Size: 50, Owner: "tom"},
+			{Name: "marble2", Color: "red", Size: 50, Owner: "jerry"},
+			{Name: "marble3", Color: "green", Size: 50, Owner: "alice"}},
+		[]AnOpenTrade{timedTrade("tom", 1, "red", "blue"), timedTrade("tom", 2, "green", "blue"),
+			timedTrade("jerry", 3, "blue", "red"), timedTrade("alice", 4, "blue", "green")})
+
+	invokeInTx(t, stub, "match", cc.matchTrade)
+
+	if owner := ownerOf(t, stub, "marble1"); owner != "jerry" {
+		t.Errorf("marble1 owned by %s, want jerry", owner)
+	}
+	if owner := ownerOf(t, stub, "marble3"); owner != "alice" {
+		t.Errorf("marble3 owned by %s, want alice", owner)
+	}
+	if users := openTradeUsers(t, stub); len(users) != 2 || users[0] != "tom" || users[1] != "alice" {
+		t.Errorf("open trades left for %v, want tom and alice", users)
+	}
+	// the skipped cycle is not tom's failure
+	r, err := loadReputation(stub, "tom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.FailedInventory != 0 {
+		t.Errorf("tom failed %d matches for missing inventory, want 0", r.FailedInventory)
+	}
+}
+
+func TestMatchTradeNeverMatchesOneUser(t *testing.T) {
+	for _, policy := range []string{selfTradeExclude, selfTradeCollapse} {
+		cc := new(SimpleChaincode)
+		stub := newMatchStub(t,
+			[]marble{{Name: "marble1", Color: "blue", Size: 50, Owner: "tom"}, {Name: "marble2", Color: "red", Size: 50, Owner: "tom"}},
+			[]AnOpenTrade{timedTrade("tom", 1, "red", "blue"), timedTrade("tom", 2, "blue", "red")})
+		invokeInTx(t, stub, "policy", cc.setSelfTradePolicy, policy)
+
+		invokeInTx(t, stub, "match", cc.matchTrade)
+
+		if users := openTradeUsers(t, stub); len(users) != 2 {
+			t.Errorf("%s: open trades left for %v, want both of tom's", policy, users)
+		}
+		if count := settlementCount(stub); count != 0 {
+			t.Errorf("%s: %d settlements, want none", policy, count)
+		}
+	}
+}
+
+// tom wants red for blue and blue for green, jerry wants green for red:
+// a triangle in which tom would give his blue marble to himself
+func selfTriangleStub(t *testing.T) *shim.MockStub {
+	return newMatchStub(t,
+		[]marble{{Name: "marble1", Color: "green", Size: 50, Owner: "tom"},
+			{Name: "marble2", Color: "red", Size: 50, Owner: "jerry"},
+			{Name: "marble3", Color: "blue", Size: 50, Owner: "tom"}},
+		[]AnOpenTrade{timedTrade("tom", 1, "red", "blue"), timedTrade("jerry", 2, "green", "red"), timedTrade("tom", 3, "blue", "green")})
+}
+
+func TestMatchTriTradeExcludesSelfTrade(t *testing.T) {
+	cc := new(SimpleChaincode)
+	stub := selfTriangleStub(t)
+
+	invokeInTx(t, stub, "match", cc.matchTriTrade)
+
+	if users := openTradeUsers(t, stub); len(users) != 3 {
+		t.Errorf("open trades left for %v, want all three", users)
+	}
+	for name, owner := range map[string]string{"marble1": "tom", "marble2": "jerry", "marble3": "tom"} {
+		if got := ownerOf(t, stub, name); got != owner {
+			t.Errorf("%s owned by %s, want %s", name, got, owner)
+		}
+	}
+	if count := settlementCount(stub); count != 0 {
+		t.Errorf("%d settlements, want none", count)
+	}
+}
+
+func TestMatchTriTradeCollapsesSelfTrade(t *testing.T) {
+	cc := new(SimpleChaincode)
+	stub := selfTriangleStub(t)
+	invokeInTx(t, stub, "policy", cc.setSelfTradePolicy, selfTradeCollapse)
+
+	invokeInTx(t, stub, "match", cc.matchTriTrade)
+
+	if users := openTradeUsers(t, stub); len(users) != 0 {
+		t.Errorf("open trades left for %v, want none", users)
+	}
+	// tom and jerry swap, tom keeps the blue marble he would have given himself
+	for name, owner := range map[string]string{"marble1": "jerry", "marble2": "tom", "marble3": "tom"} {
+		if got := ownerOf(t, stub, name); got != owner {
+			t.Errorf("%s owned by %s, want %s", name, got, owner)
+		}
+	}
+	s, err := getSettlement(stub, "match-0")
+	if err != nil || s == nil {
+		t.Fatalf("settlement match-0: %v", err)
+	}
+	if len(s.Trades) != 3 || len(s.Legs) != 2 {
+		t.Errorf("settlement fills %d trades with %d legs, want 3 trades and 2 legs", len(s.Trades), len(s.Legs))
+	}
+}
@@ -0,0 +1,219 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// ==== Physical binding ====
+// Bind a marble to its physical object: serial number, SHA-256 of the RFID/NFC tag ID and SHA-256 of a reference photo.
+// Each field is optional, pass "" to leave it unset. A field cannot be changed once set.
+// Binding is done by the custodian who attested the marble (see approveMint) or by an admin.
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["bindMarble","marble1","SN-0001","9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08",""]}'
+// peer chaincode query -C myc1 -n marbles -c '{"Args":["readMarbleByTag","9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"]}'
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+type physicalBinding struct {
+	SerialNumber string `json:"serialNumber,omitempty"`
+	TagHash      string `json:"tagHash,omitempty"`   //hex SHA-256 of the RFID/NFC tag identifier
+	PhotoHash    string `json:"photoHash,omitempty"` //hex SHA-256 of the reference photo
+}
+
+var validContentHash = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// ============================================================
+// getMarbleNameByTag - look up the tag~name uniqueness index, "" if the tag was never bound
+// ============================================================
+func getMarbleNameByTag(stub shim.ChaincodeStubInterface, tagHash string) (string, error) {
+	tagIndexKey, err := stub.CreateCompositeKey("tag~name", []string{tagHash})
+	if err != nil {
+		return "", err
+	}
+	nameAsBytes, err := stub.GetState(tagIndexKey)
+	if err != nil {
+		return "", errors.New("Failed to get tag index: " + err.Error())
+	}
+	return string(nameAsBytes), nil
+}
+
+// ============================================================
+// putTagIndex - claim a tag hash for a marble. Unlike color~name, the value is the
+// marble name so the marble can be found from the tag alone.
+// ============================================================
+func putTagIndex(stub shim.ChaincodeStubInterface, tagHash string, marbleName string) error {
+	tagIndexKey, err := stub.CreateCompositeKey("tag~name", []string{tagHash})
+	if err != nil {
+		return err
+	}
+	return stub.PutState(tagIndexKey, []byte(marbleName))
+}
+
+// ============================================================
+// parsePhysicalBinding - validate serial number, tag hash and photo hash arguments
+// ============================================================
+func parsePhysicalBinding(serialNumber string, tagHash string, photoHash string) (physicalBinding, error) {
+	binding := physicalBinding{serialNumber, strings.ToLower(tagHash), strings.ToLower(photoHash)}
+	if binding.TagHash != "" && !validContentHash.MatchString(binding.TagHash) {
+		return binding, newError(codeInvalidArgument, "Tag hash must be a hex encoded SHA-256 hash")
+	}
+	if binding.PhotoHash != "" && !validContentHash.MatchString(binding.PhotoHash) {
+		return binding, newError(codeInvalidArgument, "Photo hash must be a hex encoded SHA-256 hash")
+	}
+	return binding, nil
+}
+
+// ============================================================
+// applyPhysicalBinding - merge a binding into a marble and claim its tag.
+// A field cannot be changed once set. The caller writes the marble.
+// ============================================================
+func applyPhysicalBinding(stub shim.ChaincodeStubInterface, m *marble, binding physicalBinding) error {
+	current := physicalBinding{}
+	if m.Physical != nil {
+		current = *m.Physical
+	}
+	if binding.SerialNumber != "" {
+		if current.SerialNumber != "" && current.SerialNumber != binding.SerialNumber {
+			return newError(codeFailedPrecondition, "Marble "+m.Name+" is already bound to serial number "+current.SerialNumber)
+		}
+		current.SerialNumber = binding.SerialNumber
+	}
+	if binding.PhotoHash != "" {
+		if current.PhotoHash != "" && current.PhotoHash != binding.PhotoHash {
+			return newError(codeFailedPrecondition, "Marble "+m.Name+" is already bound to another photo")
+		}
+		current.PhotoHash = binding.PhotoHash
+	}
+	if binding.TagHash != "" && binding.TagHash != current.TagHash {
+		if current.TagHash != "" {
+			return newError(codeFailedPrecondition, "Marble "+m.Name+" is already bound to another tag")
+		}
+		// ==== The same physical tag can never back two marbles ====
+		boundTo, err := getMarbleNameByTag(stub, binding.TagHash)
+		if err != nil {
+			return err
+		} else if boundTo != "" {
+			return newError(codeAlreadyExists, "This tag is already bound to marble "+boundTo)
+		}
+		err = putTagIndex(stub, binding.TagHash, m.Name)
+		if err != nil {
+			return err
+		}
+		current.TagHash = binding.TagHash
+	}
+	if current != (physicalBinding{}) {
+		m.Physical = &current
+	}
+	return nil
+}
+
+// ============================================================
+// bindMarble - attach serial number, tag hash and photo hash to a marble
+// ============================================================
+func (t *SimpleChaincode) bindMarble(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0          1          2           3
+	// "marble1", "SN-0001", ["9f86...", ["a665..."]]
+	if len(args) < 2 || len(args) > 4 {
+		return errorWithCode(codeInvalidArgument, "Incorrect number of arguments. Expecting 2 to 4")
+	}
+
+	marbleName := args[0]
+	fields := make([]string, 3) //missing fields are left unset
+	copy(fields, args[1:])
+	if fields[0] == "" && fields[1] == "" && fields[2] == "" {
+		return errorWithCode(codeInvalidArgument, "At least one of serial number, tag hash and photo hash is required")
+	}
+	binding, err := parsePhysicalBinding(fields[0], fields[1], fields[2])
+	if err != nil {
+		return errorResponse(err)
+	}
+	fmt.Println("- start bindMarble ", marbleName)
+
+	marbleToBind, err := getMarble(stub, marbleName)
+	if err != nil {
+		return errorResponse(err)
+	} else if marbleToBind == nil {
+		return errorWithCode(codeNotFound, "Marble does not exist: "+marbleName)
+	}
+
+	// ==== Only the custodian who vouched for the marble, or an admin, can bind it ====
+	attested := false
+	if marbleToBind.Attestation != nil {
+		attested, err = callerIsUser(stub, marbleToBind.Attestation.Custodian)
+		if err != nil {
+			return errorResponse(err)
+		}
+	}
+	if !attested {
+		err = requireAdmin(stub, "bindMarble by anyone but the attesting custodian")
+		if err != nil {
+			return errorResponse(err)
+		}
+	}
+
+	err = applyPhysicalBinding(stub, marbleToBind, binding)
+	if err != nil {
+		return errorResponse(err)
+	}
+	err = putMarble(stub, marbleToBind)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	fmt.Println("- end bindMarble (success)")
+	return shim.Success(nil)
+}
+
+// ============================================================
+// readMarbleByTag - read the marble bound to a tag hash
+// ============================================================
+func (t *SimpleChaincode) readMarbleByTag(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return errorWithCode(codeInvalidArgument, "Incorrect number of arguments. Expecting tag hash of the marble to query")
+	}
+
+	tagHash := strings.ToLower(args[0])
+	marbleName, err := getMarbleNameByTag(stub, tagHash)
+	if err != nil {
+		return errorResponse(err)
+	} else if marbleName == "" {
+		return errorWithCode(codeNotFound, "No marble is bound to tag "+tagHash)
+	}
+
+	boundMarble, err := getMarble(stub, marbleName)
+	if err != nil {
+		return errorResponse(err)
+	} else if boundMarble == nil {
+		return errorWithCode(codeNotFound, "Marble does not exist: "+marbleName)
+	}
+
+	marbleAsBytes, err := json.Marshal(boundMarble)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return shim.Success(marbleAsBytes)
+}
@@ -0,0 +1,315 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// ==== Private trade intents ====
+// An open trade can be kept out of public state: the user, Want and Willing are passed in the
+// transient map under "trade" with a random salt, so they never appear in the transaction, and
+// stored in the collectionTradeIntents private data collection (see collections_config.json).
+// Public state only holds the ID, the time and the salted hash of each intent:
+//   sha256(salt "|" user "|" want color "|" want size "|" willing color "|" willing size)
+// matchPrivateTrades matches the private copies, so it must be endorsed by peers of the collection.
+// Private data needs Fabric v1.2 and instantiating with --collections-config collections_config.json.
+// export TRADE=$(echo -n '{"user":"tom","want":{"color":"red","size":50},"willing":{"color":"blue","size":35},"salt":"e3b0c442"}' | base64 | tr -d \\n)
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["openPrivateTrade"]}' --transient "{\"trade\":\"$TRADE\"}"
+// peer chaincode query -C myc1 -n marbles -c '{"Args":["readPrivateTrade","<id>"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["matchPrivateTrades"]}'
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// collectionTradeIntents is the private data collection of the private open trades
+const collectionTradeIntents = "collectionTradeIntents"
+
+// privateTrade is the private copy of an intent
+type privateTrade struct {
+	ID    string      `json:"id"`
+	Trade AnOpenTrade `json:"trade"`
+	Salt  string      `json:"salt"`
+}
+
+// privateTradeCommitment is the public trace of an intent
+type privateTradeCommitment struct {
+	ObjectType string `json:"docType"`
+	ID         string `json:"id"`
+	Timestamp  int64  `json:"timestamp"`
+	Hash       string `json:"hash"` //hex sha256 of the salted intent
+}
+
+// ============================================================
+// intentHash - salted hash of an intent. The salt keeps the few possible intents from being guessed.
+// ============================================================
+func intentHash(salt string, trade AnOpenTrade) string {
+	h := sha256.Sum256([]byte(salt + "|" + trade.User + "|" +
+		trade.Want.Color + "|" + strconv.Itoa(trade.Want.Size) + "|" +
+		trade.Willing.Color + "|" + strconv.Itoa(trade.Willing.Size)))
+	return hex.EncodeToString(h[:])
+}
+
+func getPrivateTrade(stub shim.ChaincodeStubInterface, id string) (*privateTrade, error) {
+	tradeKey, err := stub.CreateCompositeKey("privateTrade", []string{id})
+	if err != nil {
+		return nil, err
+	}
+	tradeAsBytes, err := stub.GetPrivateData(collectionTradeIntents, tradeKey)
+	if err != nil {
+		return nil, errors.New("Failed to get private trade: " + err.Error())
+	} else if tradeAsBytes == nil {
+		return nil, nil
+	}
+	private := privateTrade{}
+	err = json.Unmarshal(tradeAsBytes, &private)
+	if err != nil {
+		return nil, errors.New("Failed to decode private trade " + id + ": " + err.Error())
+	}
+	return &private, nil
+}
+
+// ============================================================
+// delPrivateTrade - remove the private copy and the public commitment of an intent
+// ============================================================
+func delPrivateTrade(stub shim.ChaincodeStubInterface, id string) error {
+	tradeKey, err := stub.CreateCompositeKey("privateTrade", []string{id})
+	if err != nil {
+		return err
+	}
+	err = stub.DelPrivateData(collectionTradeIntents, tradeKey)
+	if err != nil {
+		return err
+	}
+	return stub.DelState(tradeKey)
+}
+
+// ============================================================
+// openPrivateTrade - open a trade whose details only the collection members see
+// ============================================================
+func (t *SimpleChaincode) openPrivateTrade(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 0 {
+		return errorWithCode(codeInvalidArgument, "Incorrect number of arguments. The trade is passed in the transient map")
+	}
+	transient, err := stub.GetTransient()
+	if err != nil {
+		return errorResponse(err)
+	}
+	intentAsBytes, ok := transient["trade"]
+	if !ok {
+		return errorWithCode(codeInvalidArgument, "The trade must be passed in the transient map under \"trade\"")
+	}
+	intent := struct {
+		User    string      `json:"user"`
+		Want    Description `json:"want"`
+		Willing Description `json:"willing"`
+		Salt    string      `json:"salt"`
+	}{}
+	err = json.Unmarshal(intentAsBytes, &intent)
+	if err != nil {
+		return errorWithCode(codeInvalidArgument, "Transient trade must be a JSON object: "+err.Error())
+	}
+	if intent.User == "" || intent.Want.Color == "" || intent.Willing.Color == "" {
+		return errorWithCode(codeInvalidArgument, "Transient trade needs user, want.color and willing.color")
+	}
+	if len(intent.Salt) < 8 {
+		return errorWithCode(codeInvalidArgument, "Transient trade needs a random salt of at least 8 characters")
+	}
+	trade := AnOpenTrade{"openTrade", strings.ToLower(intent.User), 0, intent.Want, intent.Willing, 0}
+	err = requireUser(stub, trade.User)
+	if err != nil {
+		return errorResponse(err)
+	}
+	err = requireUserOrAdmin(stub, trade.User, "openPrivateTrade")
+	if err != nil {
+		return errorResponse(err)
+	}
+	trade.Timestamp, err = txTimestamp(stub)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	id := stub.GetTxID()
+	tradeKey, err := stub.CreateCompositeKey("privateTrade", []string{id})
+	if err != nil {
+		return errorResponse(err)
+	}
+	private := privateTrade{id, trade, intent.Salt}
+	privateAsBytes, err := json.Marshal(private)
+	if err != nil {
+		return errorResponse(err)
+	}
+	err = stub.PutPrivateData(collectionTradeIntents, tradeKey, privateAsBytes)
+	if err != nil {
+		return errorResponse(err)
+	}
+	commitment := privateTradeCommitment{"privateTrade", id, trade.Timestamp, intentHash(intent.Salt, trade)}
+	commitmentAsBytes, err := json.Marshal(commitment)
+	if err != nil {
+		return errorResponse(err)
+	}
+	err = stub.PutState(tradeKey, commitmentAsBytes)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	fmt.Println("- end openPrivateTrade " + id)
+	return shim.Success(commitmentAsBytes)
+}
+
+// ============================================================
+// readPrivateTrade - read the private copy of an intent, on a peer of the collection
+// ============================================================
+func (t *SimpleChaincode) readPrivateTrade(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return errorWithCode(codeInvalidArgument, "Incorrect number of arguments. Expecting ID of the private trade")
+	}
+	private, err := getPrivateTrade(stub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	} else if private == nil {
+		return errorWithCode(codeNotFound, "Private trade does not exist: "+args[0])
+	}
+	err = requireUserOrAdmin(stub, private.Trade.User, "readPrivateTrade")
+	if err != nil {
+		return errorResponse(err)
+	}
+	privateAsBytes, err := json.Marshal(private)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return shim.Success(privateAsBytes)
+}
+
+// ============================================================
+// removePrivateTrade - withdraw a private intent
+// ============================================================
+func (t *SimpleChaincode) removePrivateTrade(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return errorWithCode(codeInvalidArgument, "Incorrect number of arguments. Expecting ID of the private trade")
+	}
+	private, err := getPrivateTrade(stub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	} else if private == nil {
+		return errorWithCode(codeNotFound, "Private trade does not exist: "+args[0])
+	}
+	err = requireUserOrAdmin(stub, private.Trade.User, "removePrivateTrade")
+	if err != nil {
+		return errorResponse(err)
+	}
+	err = delPrivateTrade(stub, private.ID)
+	if err != nil {
+		return errorResponse(err)
+	}
+	err = updateReputation(stub, nil, private.Trade.User, func(r *reputation) { r.Cancelled++ })
+	if err != nil {
+		return errorResponse(err)
+	}
+	fmt.Println("- end removePrivateTrade " + private.ID)
+	return shim.Success(nil)
+}
+
+// ============================================================
+// matchPrivateTrades - match private intents in pairs and settle them.
+// The settlements do not list the intents, only the marbles that moved.
+// ============================================================
+func (t *SimpleChaincode) matchPrivateTrades(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	resultsIterator, err := stub.GetPrivateDataByPartialCompositeKey(collectionTradeIntents, "privateTrade", []string{})
+	if err != nil {
+		return errorResponse(err)
+	}
+	defer resultsIterator.Close()
+
+	intents := []privateTrade{}
+	for resultsIterator.HasNext() {
+		responseRange, err := resultsIterator.Next()
+		if err != nil {
+			return errorResponse(err)
+		}
+		private := privateTrade{}
+		err = json.Unmarshal(responseRange.Value, &private)
+		if err != nil {
+			return errorWithCode(codeInternal, "Failed to decode private trade "+responseRange.Key)
+		}
+		intents = append(intents, private)
+	}
+
+	// ==== Pairs in key order, so every endorser settles the same ones ====
+	selfTrade, err := getSelfTradePolicy(stub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	settled := 0 //sequence of the settlements of this run
+	run := newSettlementRun()
+	matched := map[string]bool{}
+	for i := range intents {
+		for j := i + 1; j < len(intents) && !matched[intents[i].ID]; j++ {
+			if matched[intents[j].ID] {
+				continue
+			}
+			first, second := intents[i].Trade, intents[j].Trade
+			if !reflect.DeepEqual(first.Want, second.Willing) || !reflect.DeepEqual(first.Willing, second.Want) || creditsNet(first, second) != 0 ||
+				!selfTradeAllowed(selfTrade, first, second) {
+				continue
+			}
+			legs := []swapLeg{{first.User, first.Willing.Color, first.Willing.Size}, {second.User, second.Willing.Color, second.Willing.Size}}
+			exhausted, err := run.exhausted(stub, legs)
+			if err != nil {
+				return errorResponse(err)
+			} else if exhausted {
+				fmt.Println("- matchPrivateTrades: marbles already traded in this run " + intents[i].ID + " " + intents[j].ID)
+				continue
+			}
+			s, err := settleSwap(stub, run, settlementPair, settled, legs, nil)
+			if err != nil && errorCode(err) == codeInternal {
+				return errorResponse(err)
+			}
+			if err == nil {
+				err = recordMatchOutcome(stub, run, s, []AnOpenTrade{first, second})
+				if err != nil {
+					return errorResponse(err)
+				}
+			}
+			if err != nil || s == nil {
+				fmt.Println("- matchPrivateTrades: not settled " + intents[i].ID + " " + intents[j].ID)
+				continue
+			}
+			settled++
+			matched[intents[i].ID], matched[intents[j].ID] = true, true
+			for _, id := range []string{intents[i].ID, intents[j].ID} {
+				err = delPrivateTrade(stub, id)
+				if err != nil {
+					return errorResponse(err)
+				}
+			}
+		}
+	}
+
+	fmt.Printf("- end matchPrivateTrades: %d settled\n", settled)
+	return shim.Success([]byte(strconv.Itoa(settled)))
+}
@@ -0,0 +1,88 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// ==== Provenance digest ====
+// getProvenance returns the history of a marble, oldest first, with a running hash chain over
+// the marble name and each record; the digest is the last hash. The chain is computed by the
+// provenance package, which tools/verifyProvenance uses to check an exported result off-chain.
+// Compare the digest of an export with the digest of a fresh query.
+// peer chaincode query -C myc1 -n marbles -c '{"Args":["getProvenance","marble1"]}'
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"github.com/marbles02/provenance"
+)
+
+// ============================================================
+// getProvenance - history of a marble with its hash chain
+// ============================================================
+func (t *SimpleChaincode) getProvenance(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return errorWithCode(codeInvalidArgument, "Incorrect number of arguments. Expecting name of the marble")
+	}
+	marbleName := args[0]
+	fmt.Printf("- start getProvenance: %s\n", marbleName)
+
+	resultsIterator, err := stub.GetHistoryForKey(marbleName)
+	if err != nil {
+		return errorResponse(err)
+	}
+	defer resultsIterator.Close()
+
+	result := provenance.Provenance{Marble: marbleName, Algorithm: provenance.Algorithm, Records: []provenance.Record{}}
+	for resultsIterator.HasNext() {
+		modification, err := resultsIterator.Next()
+		if err != nil {
+			return errorResponse(err)
+		}
+		record := provenance.Record{TxID: modification.TxId, IsDelete: modification.IsDelete, Value: json.RawMessage("null")}
+		if modification.Timestamp != nil {
+			record.Timestamp = time.Unix(modification.Timestamp.Seconds, int64(modification.Timestamp.Nanos)).UTC().Format(time.RFC3339Nano)
+		}
+		if !modification.IsDelete {
+			if !json.Valid(modification.Value) {
+				return errorWithCode(codeInternal, "Value of "+marbleName+" in transaction "+modification.TxId+" is not JSON")
+			}
+			record.Value = json.RawMessage(modification.Value)
+		}
+		record.Hash, err = provenance.ChainHash(marbleName, result.Digest, record)
+		if err != nil {
+			return errorResponse(err)
+		}
+		result.Digest = record.Hash
+		result.Records = append(result.Records, record)
+	}
+	if len(result.Records) == 0 {
+		return errorWithCode(codeNotFound, "Marble has no history: "+marbleName)
+	}
+
+	resultAsBytes, err := json.Marshal(result)
+	if err != nil {
+		return errorResponse(err)
+	}
+	fmt.Printf("- end getProvenance: %d records, digest %s\n", len(result.Records), result.Digest)
+	return shim.Success(resultAsBytes)
+}
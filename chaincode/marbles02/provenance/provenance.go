@@ -0,0 +1,81 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// ==== Provenance hash chain ====
+// The hash chain over the history of a marble, shared by the getProvenance
+// query of the chaincode and tools/verifyProvenance, so both compute the same hashes:
+//   hash[i] = hex(sha256(hash[i-1] "|" marble "|" txId "|" timestamp "|" isDelete "|" value)), hash[-1] = ""
+// where timestamp is RFC 3339 with nanoseconds in UTC, isDelete is "true" or "false" and value is
+// the marble as written re-encoded by encoding/json with sorted keys, "null" for a delete.
+// The marble name ties a chain to its marble, so it cannot be passed off as another marble's history.
+
+package provenance
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+)
+
+// Algorithm names the hash chain construction, so verifiers can reject one they do not know
+const Algorithm = "sha256-chain-v2"
+
+// Record is one history entry of a marble with the chain hash up to and including it
+type Record struct {
+	TxID      string          `json:"txId"`
+	Timestamp string          `json:"timestamp"` //RFC 3339 with nanoseconds, UTC
+	IsDelete  bool            `json:"isDelete"`
+	Value     json.RawMessage `json:"value"`
+	Hash      string          `json:"hash"`
+}
+
+// Provenance is the result of the getProvenance query
+type Provenance struct {
+	Marble    string   `json:"marble"`
+	Algorithm string   `json:"algorithm"`
+	Records   []Record `json:"records"`
+	Digest    string   `json:"digest"` //hash of the last record, "" without history
+}
+
+// ChainHash returns the hash of a record of the marble following the previous hash
+func ChainHash(marble string, previous string, record Record) (string, error) {
+	value, err := CanonicalJSON(record.Value)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	h.Write([]byte(previous + "|" + marble + "|" + record.TxID + "|" + record.Timestamp + "|" + strconv.FormatBool(record.IsDelete) + "|"))
+	h.Write(value)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// CanonicalJSON re-encodes a JSON value with sorted keys and encoding/json escaping,
+// so the hash does not depend on how an export was formatted
+func CanonicalJSON(value json.RawMessage) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(value))
+	decoder.UseNumber() //keep numbers as written
+	var decoded interface{}
+	err := decoder.Decode(&decoded)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(decoded)
+}
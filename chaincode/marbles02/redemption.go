@@ -0,0 +1,182 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// ==== Redemption ====
+// The owner asks to take the physical marble out of the system, which locks the marble.
+// The custodian confirms the handover and the marble is burned: the record stays in state
+// as a tombstone with status "burned" so its history ends with who redeemed it and when.
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["requestRedemption","marble1"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["cancelRedemption","marble1"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["confirmRedemption","marble1","vault"]}'
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+const (
+	marbleStatusRedeeming = "redeeming" //locked until the custodian confirms the handover
+	marbleStatusBurned    = "burned"    //tombstone of a redeemed marble
+)
+
+type redemption struct {
+	RequestedBy string `json:"requestedBy"` //owner who asked for the physical marble
+	Requested   int64  `json:"requested"`
+	RequestTxID string `json:"requestTxId"`
+	Custodian   string `json:"custodian,omitempty"` //custodian who handed the marble over
+	Redeemed    int64  `json:"redeemed,omitempty"`
+	RedeemTxID  string `json:"redeemTxId,omitempty"`
+}
+
+// ============================================================
+// getMarbleForRedemption - read a marble and check its status
+// ============================================================
+func getMarbleForRedemption(stub shim.ChaincodeStubInterface, marbleName string, status string) (*marble, error) {
+	m, err := getMarble(stub, marbleName)
+	if err != nil {
+		return nil, err
+	} else if m == nil {
+		return nil, newError(codeNotFound, "Marble does not exist: "+marbleName)
+	}
+	if m.Status != status {
+		return nil, newError(codeFailedPrecondition, "Marble "+marbleName+" is "+m.Status+", expecting "+status)
+	}
+	return m, nil
+}
+
+// ============================================================
+// requestRedemption - owner asks for the physical marble, the marble is locked
+// ============================================================
+func (t *SimpleChaincode) requestRedemption(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return errorWithCode(codeInvalidArgument, "Incorrect number of arguments. Expecting 1")
+	}
+
+	marbleName := args[0]
+	fmt.Println("- start requestRedemption ", marbleName)
+	m, err := getMarbleForRedemption(stub, marbleName, marbleStatusActive)
+	if err != nil {
+		return errorResponse(err)
+	}
+	owner, err := callerIsUser(stub, m.Owner)
+	if err != nil {
+		return errorResponse(err)
+	} else if !owner {
+		return errorWithCode(codeForbidden, "requestRedemption must be signed by the owner "+m.Owner)
+	}
+
+	requested, err := txTimestamp(stub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	m.Status = marbleStatusRedeeming
+	m.Redemption = &redemption{RequestedBy: m.Owner, Requested: requested, RequestTxID: stub.GetTxID()}
+	err = putMarble(stub, m)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	fmt.Println("- end requestRedemption (success)")
+	return shim.Success(nil)
+}
+
+// ============================================================
+// cancelRedemption - owner or admin unlocks a marble waiting for redemption
+// ============================================================
+func (t *SimpleChaincode) cancelRedemption(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return errorWithCode(codeInvalidArgument, "Incorrect number of arguments. Expecting 1")
+	}
+
+	marbleName := args[0]
+	m, err := getMarbleForRedemption(stub, marbleName, marbleStatusRedeeming)
+	if err != nil {
+		return errorResponse(err)
+	}
+	err = requireUserOrAdmin(stub, m.Owner, "cancelRedemption")
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	m.Status = marbleStatusActive
+	m.Redemption = nil
+	err = putMarble(stub, m)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	fmt.Println("- end cancelRedemption " + marbleName)
+	return shim.Success(nil)
+}
+
+// ============================================================
+// confirmRedemption - custodian confirms the handover and the marble is burned
+// ============================================================
+func (t *SimpleChaincode) confirmRedemption(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0          1
+	// "marble1", "vault"
+	if len(args) != 2 {
+		return errorWithCode(codeInvalidArgument, "Incorrect number of arguments. Expecting 2")
+	}
+
+	marbleName := args[0]
+	custodian := strings.ToLower(args[1])
+	fmt.Println("- start confirmRedemption ", marbleName, custodian)
+	m, err := getMarbleForRedemption(stub, marbleName, marbleStatusRedeeming)
+	if err != nil {
+		return errorResponse(err)
+	}
+	// the custodian who attested the marble holds it, marbles minted before attestation can be released by any custodian
+	if m.Attestation != nil && m.Attestation.Custodian != custodian {
+		return errorWithCode(codeForbidden, "Marble "+marbleName+" is held by custodian "+m.Attestation.Custodian)
+	}
+	err = requireCustodian(stub, custodian, "confirmRedemption")
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	redeemed, err := txTimestamp(stub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	m.Status = marbleStatusBurned
+	m.Redemption.Custodian = custodian
+	m.Redemption.Redeemed = redeemed
+	m.Redemption.RedeemTxID = stub.GetTxID()
+	err = putMarble(stub, m)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	// a burned marble no longer shows up in color queries. The tag~name entry is kept
+	// so the same physical tag can never be minted again.
+	err = delColorIndex(stub, m)
+	if err != nil {
+		return shim.Error("Failed to delete state:" + err.Error())
+	}
+
+	fmt.Println("- end confirmRedemption (burned)")
+	return shim.Success(nil)
+}
@@ -0,0 +1,146 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// ==== Reputation ====
+// Per-user counters kept up to date by the matchers and by cancellations: open trades filled,
+// cancelled by the user, and matches that failed because the user no longer had the marble
+// they were willing to trade, plus the average time from opening a trade to its fill.
+// peer chaincode query -C myc1 -n marbles -c '{"Args":["getReputation","tom"]}'
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+type reputation struct {
+	ObjectType         string `json:"docType"`
+	User               string `json:"user"`
+	Filled             int    `json:"filled"`
+	Cancelled          int    `json:"cancelled"`
+	FailedInventory    int    `json:"failedMissingInventory"`
+	FillSeconds        int64  `json:"fillSeconds"`        //total time from opening to fill of the filled trades
+	AverageFillSeconds int64  `json:"averageFillSeconds"` //0 until a trade is filled
+}
+
+func loadReputation(stub shim.ChaincodeStubInterface, user string) (*reputation, error) {
+	reputationKey, err := stub.CreateCompositeKey("reputation", []string{user})
+	if err != nil {
+		return nil, err
+	}
+	reputationAsBytes, err := stub.GetState(reputationKey)
+	if err != nil {
+		return nil, errors.New("Failed to get reputation: " + err.Error())
+	}
+	r := reputation{ObjectType: "reputation", User: user}
+	if reputationAsBytes != nil {
+		err = json.Unmarshal(reputationAsBytes, &r)
+		if err != nil {
+			return nil, errors.New("Failed to decode reputation of " + user + ": " + err.Error())
+		}
+	}
+	return &r, nil
+}
+
+func putReputation(stub shim.ChaincodeStubInterface, r *reputation) error {
+	if r.Filled > 0 {
+		r.AverageFillSeconds = r.FillSeconds / int64(r.Filled)
+	}
+	reputationKey, err := stub.CreateCompositeKey("reputation", []string{r.User})
+	if err != nil {
+		return err
+	}
+	reputationAsBytes, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(reputationKey, reputationAsBytes)
+}
+
+// ============================================================
+// updateReputation - apply a change to the counters of a user. Within a match run the
+// counters are carried over from the previous settlements of the run.
+// ============================================================
+func updateReputation(stub shim.ChaincodeStubInterface, run *settlementRun, user string, change func(*reputation)) error {
+	var r *reputation
+	if run != nil && run.reputations[user] != nil {
+		r = run.reputations[user]
+	} else {
+		var err error
+		r, err = loadReputation(stub, user)
+		if err != nil {
+			return err
+		}
+	}
+	change(r)
+	if run != nil {
+		run.reputations[user] = r
+	}
+	return putReputation(stub, r)
+}
+
+// ============================================================
+// recordMatchOutcome - count the fills of a settled match, or the failure of the user
+// who had no marble to give when the match could not be settled
+// ============================================================
+func recordMatchOutcome(stub shim.ChaincodeStubInterface, run *settlementRun, s *settlement, trades []AnOpenTrade) error {
+	if s == nil {
+		if run.shortOf == "" {
+			return nil
+		}
+		return updateReputation(stub, run, run.shortOf, func(r *reputation) { r.FailedInventory++ })
+	}
+	for _, trade := range trades {
+		waited := s.Timestamp - trade.Timestamp
+		if waited < 0 {
+			waited = 0 //trade timestamps come from the peer clock
+		}
+		err := updateReputation(stub, run, trade.User, func(r *reputation) {
+			r.Filled++
+			r.FillSeconds += waited
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ============================================================
+// getReputation - read the reputation counters of a user
+// ============================================================
+func (t *SimpleChaincode) getReputation(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return errorWithCode(codeInvalidArgument, "Incorrect number of arguments. Expecting user")
+	}
+	r, err := loadReputation(stub, strings.ToLower(args[0]))
+	if err != nil {
+		return errorResponse(err)
+	}
+	reputationAsBytes, err := json.Marshal(r)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return shim.Success(reputationAsBytes)
+}
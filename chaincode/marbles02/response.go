@@ -0,0 +1,148 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// ==== Response envelope ====
+// Every invoke and query answers with the same JSON document:
+//   {"status":"ok","code":"OK","data":{"docType":"marble","name":"marble1",...}}
+//   {"status":"error","code":"NOT_FOUND","message":"Marble does not exist: marble9"}
+// A failure is still a chaincode error, so the transaction is not endorsed; the envelope is
+// the error message and the code is also carried by the response status (4xx, or 500 for INTERNAL).
+
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// error codes, clients should switch on these rather than on the message
+const (
+	codeOK                 = "OK"
+	codeInvalidArgument    = "INVALID_ARGUMENT"    //wrong number, format or value of arguments
+	codeForbidden          = "FORBIDDEN"           //the caller is not allowed to do this
+	codeNotFound           = "NOT_FOUND"           //marble, trade, user, ... does not exist
+	codeAlreadyExists      = "ALREADY_EXISTS"      //the key to create is taken
+	codeFailedPrecondition = "FAILED_PRECONDITION" //the object exists but its state does not allow this, e.g. a locked marble
+	codeInternal           = "INTERNAL"            //state database, encoding or any unexpected error
+)
+
+var statusByCode = map[string]int32{
+	codeInvalidArgument:    400,
+	codeForbidden:          403,
+	codeNotFound:           404,
+	codeAlreadyExists:      409,
+	codeFailedPrecondition: 412,
+	codeInternal:           shim.ERROR,
+}
+
+type responseEnvelope struct {
+	Status  string          `json:"status"` //"ok" or "error"
+	Code    string          `json:"code"`
+	Message string          `json:"message,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+// chaincodeError is an error with an error code
+type chaincodeError struct {
+	code    string
+	message string
+}
+
+func (e *chaincodeError) Error() string {
+	return e.message
+}
+
+func newError(code string, message string) error {
+	return &chaincodeError{code, message}
+}
+
+// ============================================================
+// errorCode - code of an error, INTERNAL unless it was created with newError
+// ============================================================
+func errorCode(err error) string {
+	if coded, ok := err.(*chaincodeError); ok {
+		return coded.code
+	}
+	return codeInternal
+}
+
+// ============================================================
+// errorWithCode - failure response carrying an error code
+// ============================================================
+func errorWithCode(code string, message string) pb.Response {
+	return pb.Response{Status: statusByCode[code], Message: message}
+}
+
+// ============================================================
+// errorWithData - failure response with details, e.g. one error per entry of a batch
+// ============================================================
+func errorWithData(code string, message string, data []byte) pb.Response {
+	return pb.Response{Status: statusByCode[code], Message: message, Payload: data}
+}
+
+// ============================================================
+// errorResponse - failure response for an error, see errorCode
+// ============================================================
+func errorResponse(err error) pb.Response {
+	return errorWithCode(errorCode(err), err.Error())
+}
+
+func codeForStatus(status int32) string {
+	for code, codeStatus := range statusByCode {
+		if codeStatus == status {
+			return code
+		}
+	}
+	return codeInternal
+}
+
+// ============================================================
+// wrapResponse - turn the response of a function into the envelope.
+// Payloads that are not JSON are returned as a JSON string.
+// ============================================================
+func wrapResponse(response pb.Response) pb.Response {
+	envelope := responseEnvelope{Status: "ok", Code: codeOK}
+	if response.Status >= shim.ERRORTHRESHOLD {
+		envelope = responseEnvelope{Status: "error", Code: codeForStatus(response.Status), Message: response.Message}
+		if len(response.Payload) > 0 && json.Valid(response.Payload) {
+			envelope.Data = json.RawMessage(response.Payload)
+		}
+	} else if len(response.Payload) > 0 {
+		if json.Valid(response.Payload) {
+			envelope.Data = json.RawMessage(response.Payload)
+		} else {
+			data, err := json.Marshal(string(response.Payload))
+			if err != nil {
+				return errorResponse(err)
+			}
+			envelope.Data = data
+		}
+	}
+
+	envelopeAsBytes, err := json.Marshal(envelope)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if envelope.Status != "ok" {
+		return pb.Response{Status: response.Status, Message: string(envelopeAsBytes)}
+	}
+	return shim.Success(envelopeAsBytes)
+}
@@ -0,0 +1,270 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// ==== Asset class schemas ====
+// Each call to defineSchema stores a new version of the attribute schema for an asset class:
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["defineSchema","marble","[{\"name\":\"material\",\"type\":\"string\",\"required\":true},{\"name\":\"pattern\",\"type\":\"string\",\"enum\":[\"solid\",\"swirl\",\"cat-eye\"]},{\"name\":\"grade\",\"type\":\"integer\"},{\"name\":\"year\",\"type\":\"integer\"}]"]}'
+// peer chaincode query -C myc1 -n marbles -c '{"Args":["readSchema","marble"]}'
+// peer chaincode query -C myc1 -n marbles -c '{"Args":["readSchema","marble","1"]}'
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+type schemaField struct {
+	Name     string   `json:"name"`
+	Type     string   `json:"type"` //string, integer, number or boolean
+	Required bool     `json:"required,omitempty"`
+	Enum     []string `json:"enum,omitempty"` //allowed values of a string field
+}
+
+type assetSchema struct {
+	ObjectType string        `json:"docType"` //docType is used to distinguish the various types of objects in state database
+	AssetClass string        `json:"assetClass"`
+	Version    int           `json:"version"`
+	Fields     []schemaField `json:"fields"`
+}
+
+var schemaFieldTypes = map[string]bool{"string": true, "integer": true, "number": true, "boolean": true}
+
+// ============================================================
+// schemaKey - composite key of a schema version, padded so versions sort in order
+// ============================================================
+func schemaKey(stub shim.ChaincodeStubInterface, assetClass string, version int) (string, error) {
+	return stub.CreateCompositeKey("assetSchema", []string{assetClass, fmt.Sprintf("%08d", version)})
+}
+
+// ============================================================
+// getSchema - read a schema version, or the latest one when version is 0.
+// Returns nil if the asset class has no schema.
+// ============================================================
+func getSchema(stub shim.ChaincodeStubInterface, assetClass string, version int) (*assetSchema, error) {
+	var schemaAsBytes []byte
+	if version > 0 {
+		key, err := schemaKey(stub, assetClass, version)
+		if err != nil {
+			return nil, err
+		}
+		schemaAsBytes, err = stub.GetState(key)
+		if err != nil {
+			return nil, errors.New("Failed to get schema: " + err.Error())
+		}
+	} else {
+		resultsIterator, err := stub.GetStateByPartialCompositeKey("assetSchema", []string{assetClass})
+		if err != nil {
+			return nil, err
+		}
+		defer resultsIterator.Close()
+		// keys are ordered by padded version, the last one is the latest
+		for resultsIterator.HasNext() {
+			queryResponse, err := resultsIterator.Next()
+			if err != nil {
+				return nil, err
+			}
+			schemaAsBytes = queryResponse.Value
+		}
+	}
+	if schemaAsBytes == nil {
+		return nil, nil
+	}
+
+	schema := assetSchema{}
+	err := json.Unmarshal(schemaAsBytes, &schema)
+	if err != nil {
+		return nil, errors.New("Failed to decode schema of " + assetClass + ": " + err.Error())
+	}
+	return &schema, nil
+}
+
+// ============================================================
+// validateAttributes - check attributes against a schema
+// ============================================================
+func validateAttributes(schema *assetSchema, attributes map[string]interface{}) error {
+	if schema == nil {
+		if len(attributes) > 0 {
+			return newError(codeInvalidArgument, "Attributes are not allowed, no schema is defined for this asset class")
+		}
+		return nil
+	}
+
+	fields := make(map[string]schemaField)
+	for _, field := range schema.Fields {
+		fields[field.Name] = field
+		if _, ok := attributes[field.Name]; field.Required && !ok {
+			return newError(codeInvalidArgument, fmt.Sprintf("Attribute %q is required by %s schema version %d", field.Name, schema.AssetClass, schema.Version))
+		}
+	}
+
+	// check in a stable order so the same input always reports the same error
+	names := make([]string, 0, len(attributes))
+	for name := range attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		field, ok := fields[name]
+		if !ok {
+			return newError(codeInvalidArgument, fmt.Sprintf("Attribute %q is not defined by %s schema version %d", name, schema.AssetClass, schema.Version))
+		}
+		err := validateAttributeValue(field, attributes[name])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateAttributeValue(field schemaField, value interface{}) error {
+	switch field.Type {
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			return newError(codeInvalidArgument, fmt.Sprintf("Attribute %q must be a string", field.Name))
+		}
+		if len(field.Enum) > 0 {
+			for _, allowed := range field.Enum {
+				if str == allowed {
+					return nil
+				}
+			}
+			return newError(codeInvalidArgument, fmt.Sprintf("Attribute %q must be one of %v", field.Name, field.Enum))
+		}
+	case "integer":
+		number, ok := value.(float64)
+		if !ok || number != math.Trunc(number) {
+			return newError(codeInvalidArgument, fmt.Sprintf("Attribute %q must be an integer", field.Name))
+		}
+	case "number":
+		if _, ok := value.(float64); !ok {
+			return newError(codeInvalidArgument, fmt.Sprintf("Attribute %q must be a number", field.Name))
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return newError(codeInvalidArgument, fmt.Sprintf("Attribute %q must be a boolean", field.Name))
+		}
+	}
+	return nil
+}
+
+// ============================================================
+// defineSchema - store a new schema version for an asset class
+// ============================================================
+func (t *SimpleChaincode) defineSchema(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0         1
+	// "marble", "[{\"name\":\"material\",\"type\":\"string\"}]"
+	if len(args) != 2 {
+		return errorWithCode(codeInvalidArgument, "Incorrect number of arguments. Expecting 2")
+	}
+	if len(args[0]) <= 0 {
+		return errorWithCode(codeInvalidArgument, "1st argument must be a non-empty string")
+	}
+	assetClass := args[0]
+
+	var fields []schemaField
+	err := json.Unmarshal([]byte(args[1]), &fields)
+	if err != nil {
+		return errorWithCode(codeInvalidArgument, "2nd argument must be a JSON array of fields: "+err.Error())
+	}
+	seen := make(map[string]bool)
+	for _, field := range fields {
+		if len(field.Name) <= 0 {
+			return errorWithCode(codeInvalidArgument, "Schema field names must be non-empty strings")
+		}
+		if seen[field.Name] {
+			return errorWithCode(codeInvalidArgument, "Duplicate schema field: "+field.Name)
+		}
+		seen[field.Name] = true
+		if !schemaFieldTypes[field.Type] {
+			return errorWithCode(codeInvalidArgument, "Schema field "+field.Name+" has unknown type "+field.Type)
+		}
+		if len(field.Enum) > 0 && field.Type != "string" {
+			return errorWithCode(codeInvalidArgument, "Schema field "+field.Name+": enum is only allowed on string fields")
+		}
+	}
+
+	latest, err := getSchema(stub, assetClass, 0)
+	if err != nil {
+		return errorResponse(err)
+	}
+	schema := assetSchema{"assetSchema", assetClass, 1, fields}
+	if latest != nil {
+		schema.Version = latest.Version + 1
+	}
+
+	schemaJSONasBytes, err := json.Marshal(schema)
+	if err != nil {
+		return errorResponse(err)
+	}
+	key, err := schemaKey(stub, assetClass, schema.Version)
+	if err != nil {
+		return errorResponse(err)
+	}
+	err = stub.PutState(key, schemaJSONasBytes)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	fmt.Printf("- end defineSchema %s version %d\n", assetClass, schema.Version)
+	return shim.Success([]byte(strconv.Itoa(schema.Version)))
+}
+
+// ============================================================
+// readSchema - read the latest or a given schema version of an asset class
+// ============================================================
+func (t *SimpleChaincode) readSchema(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0         1
+	// "marble", ["2"]
+	if len(args) != 1 && len(args) != 2 {
+		return errorWithCode(codeInvalidArgument, "Incorrect number of arguments. Expecting 1 or 2")
+	}
+
+	version := 0
+	if len(args) == 2 {
+		var err error
+		version, err = strconv.Atoi(args[1])
+		if err != nil || version <= 0 {
+			return errorWithCode(codeInvalidArgument, "2nd argument must be a positive numeric string")
+		}
+	}
+
+	schema, err := getSchema(stub, args[0], version)
+	if err != nil {
+		return errorResponse(err)
+	} else if schema == nil {
+		return errorWithCode(codeNotFound, "Schema does not exist: "+args[0])
+	}
+
+	schemaAsBytes, err := json.Marshal(schema)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return shim.Success(schemaAsBytes)
+}
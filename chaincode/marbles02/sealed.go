@@ -0,0 +1,390 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// ==== Sealed trade intents ====
+// A sealed round has a commit window and a reveal window, opened by an admin.
+// During the commit window users submit only the salted hash of their intent, computed as for
+// private trades: sha256(salt "|" user "|" want color "|" want size "|" willing color "|" willing size).
+// During the reveal window they reveal the intent and salt; a reveal must match its commitment.
+// Once the reveal window is over, closeSealedRound adds the revealed intents to AllOpenTrades, in
+// commitment order, for the next match run. Unrevealed commitments are dropped.
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["openSealedRound","3600","1800"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["commitTradeIntent","tom","9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["revealTradeIntent","<commitment id>","red","50","blue","35","e3b0c442"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["closeSealedRound"]}'
+// peer chaincode query -C myc1 -n marbles -c '{"Args":["readSealedRound"]}'
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+var sealedRoundStr = "_sealedround" //name for the key/value that will store the current sealed round
+
+var validIntentHash = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+type sealedRound struct {
+	ObjectType  string `json:"docType"`
+	Round       int    `json:"round"`
+	OpenedAt    int64  `json:"openedAt"`
+	CommitUntil int64  `json:"commitUntil"` //commitments are accepted before this time
+	RevealUntil int64  `json:"revealUntil"` //reveals are accepted from commitUntil until this time
+	Closed      bool   `json:"closed"`
+}
+
+type sealedIntent struct {
+	ObjectType  string       `json:"docType"`
+	ID          string       `json:"id"` //transaction of the commitment
+	Round       int          `json:"round"`
+	User        string       `json:"user"`
+	Hash        string       `json:"hash"`
+	CommittedAt int64        `json:"committedAt"`
+	Trade       *AnOpenTrade `json:"trade,omitempty"` //set once revealed
+	RevealedAt  int64        `json:"revealedAt,omitempty"`
+}
+
+func getSealedRound(stub shim.ChaincodeStubInterface) (*sealedRound, error) {
+	roundAsBytes, err := stub.GetState(sealedRoundStr)
+	if err != nil {
+		return nil, errors.New("Failed to get sealed round: " + err.Error())
+	} else if roundAsBytes == nil {
+		return nil, nil
+	}
+	round := sealedRound{}
+	err = json.Unmarshal(roundAsBytes, &round)
+	if err != nil {
+		return nil, errors.New("Failed to decode sealed round: " + err.Error())
+	}
+	return &round, nil
+}
+
+func putSealedRound(stub shim.ChaincodeStubInterface, round *sealedRound) error {
+	roundAsBytes, err := json.Marshal(round)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(sealedRoundStr, roundAsBytes)
+}
+
+// ============================================================
+// currentSealedRound - the round still open, with the transaction time
+// ============================================================
+func currentSealedRound(stub shim.ChaincodeStubInterface) (*sealedRound, int64, error) {
+	round, err := getSealedRound(stub)
+	if err != nil {
+		return nil, 0, err
+	} else if round == nil || round.Closed {
+		return nil, 0, newError(codeFailedPrecondition, "No sealed round is open")
+	}
+	now, err := txTimestamp(stub)
+	if err != nil {
+		return nil, 0, err
+	}
+	return round, now, nil
+}
+
+func sealedIntentKey(stub shim.ChaincodeStubInterface, round int, id string) (string, error) {
+	// zero padded so the intents of a round read back in order
+	return stub.CreateCompositeKey("sealedIntent", []string{fmt.Sprintf("%010d", round), id})
+}
+
+func putSealedIntent(stub shim.ChaincodeStubInterface, intent *sealedIntent) error {
+	intentKey, err := sealedIntentKey(stub, intent.Round, intent.ID)
+	if err != nil {
+		return err
+	}
+	intentAsBytes, err := json.Marshal(intent)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(intentKey, intentAsBytes)
+}
+
+// ============================================================
+// openSealedRound - start a round with a commit window then a reveal window, in seconds
+// ============================================================
+func (t *SimpleChaincode) openSealedRound(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0       1
+	// "3600", "1800"
+	if len(args) != 2 {
+		return errorWithCode(codeInvalidArgument, "Incorrect number of arguments. Expecting commit and reveal window in seconds")
+	}
+	commitSeconds, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil || commitSeconds <= 0 {
+		return errorWithCode(codeInvalidArgument, "1st argument must be a positive numeric string")
+	}
+	revealSeconds, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil || revealSeconds <= 0 {
+		return errorWithCode(codeInvalidArgument, "2nd argument must be a positive numeric string")
+	}
+
+	previous, err := getSealedRound(stub)
+	if err != nil {
+		return errorResponse(err)
+	} else if previous != nil && !previous.Closed {
+		return errorWithCode(codeFailedPrecondition, "Sealed round "+strconv.Itoa(previous.Round)+" is not closed yet")
+	}
+	now, err := txTimestamp(stub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	round := &sealedRound{"sealedRound", 1, now, now + commitSeconds, now + commitSeconds + revealSeconds, false}
+	if previous != nil {
+		round.Round = previous.Round + 1
+	}
+	err = putSealedRound(stub, round)
+	if err != nil {
+		return errorResponse(err)
+	}
+	roundAsBytes, err := json.Marshal(round)
+	if err != nil {
+		return errorResponse(err)
+	}
+	fmt.Println("- end openSealedRound " + strconv.Itoa(round.Round))
+	return shim.Success(roundAsBytes)
+}
+
+// ============================================================
+// readSealedRound - read the current or last sealed round
+// ============================================================
+func (t *SimpleChaincode) readSealedRound(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	round, err := getSealedRound(stub)
+	if err != nil {
+		return errorResponse(err)
+	} else if round == nil {
+		return errorWithCode(codeNotFound, "No sealed round has been opened")
+	}
+	roundAsBytes, err := json.Marshal(round)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return shim.Success(roundAsBytes)
+}
+
+// ============================================================
+// commitTradeIntent - submit the hash of a trade intent during the commit window
+// ============================================================
+func (t *SimpleChaincode) commitTradeIntent(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0      1
+	// "tom", "9f86d0..."
+	if len(args) != 2 {
+		return errorWithCode(codeInvalidArgument, "Incorrect number of arguments. Expecting user and hash")
+	}
+	user := strings.ToLower(args[0])
+	hash := strings.ToLower(args[1])
+	if !validIntentHash.MatchString(hash) {
+		return errorWithCode(codeInvalidArgument, "2nd argument must be a hex encoded SHA-256 hash")
+	}
+	err := requireUser(stub, user)
+	if err != nil {
+		return errorResponse(err)
+	}
+	err = requireUserOrAdmin(stub, user, "commitTradeIntent")
+	if err != nil {
+		return errorResponse(err)
+	}
+	round, now, err := currentSealedRound(stub)
+	if err != nil {
+		return errorResponse(err)
+	} else if now >= round.CommitUntil {
+		return errorWithCode(codeFailedPrecondition, "The commit window of sealed round "+strconv.Itoa(round.Round)+" is over")
+	}
+
+	intent := &sealedIntent{ObjectType: "sealedIntent", ID: stub.GetTxID(), Round: round.Round, User: user, Hash: hash, CommittedAt: now}
+	err = putSealedIntent(stub, intent)
+	if err != nil {
+		return errorResponse(err)
+	}
+	intentAsBytes, err := json.Marshal(intent)
+	if err != nil {
+		return errorResponse(err)
+	}
+	fmt.Println("- end commitTradeIntent " + intent.ID)
+	return shim.Success(intentAsBytes)
+}
+
+// ============================================================
+// revealTradeIntent - reveal a committed intent during the reveal window
+// ============================================================
+func (t *SimpleChaincode) revealTradeIntent(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0      1      2     3       4     5
+	// "<id>", "red", "50", "blue", "35", "e3b0c442"
+	if len(args) != 6 {
+		return errorWithCode(codeInvalidArgument, "Incorrect number of arguments. Expecting 6")
+	}
+	size1, err := strconv.Atoi(args[2])
+	if err != nil {
+		return errorWithCode(codeInvalidArgument, "3rd argument must be a numeric string")
+	}
+	size2, err := strconv.Atoi(args[4])
+	if err != nil {
+		return errorWithCode(codeInvalidArgument, "5th argument must be a numeric string")
+	}
+	round, now, err := currentSealedRound(stub)
+	if err != nil {
+		return errorResponse(err)
+	} else if now < round.CommitUntil {
+		return errorWithCode(codeFailedPrecondition, "The reveal window of sealed round "+strconv.Itoa(round.Round)+" has not started")
+	} else if now >= round.RevealUntil {
+		return errorWithCode(codeFailedPrecondition, "The reveal window of sealed round "+strconv.Itoa(round.Round)+" is over")
+	}
+
+	intentKey, err := sealedIntentKey(stub, round.Round, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	intentAsBytes, err := stub.GetState(intentKey)
+	if err != nil {
+		return errorResponse(err)
+	} else if intentAsBytes == nil {
+		return errorWithCode(codeNotFound, "No commitment "+args[0]+" in sealed round "+strconv.Itoa(round.Round))
+	}
+	intent := sealedIntent{}
+	err = json.Unmarshal(intentAsBytes, &intent)
+	if err != nil {
+		return errorWithCode(codeInternal, "Failed to decode commitment "+args[0])
+	}
+	if intent.Trade != nil {
+		return errorWithCode(codeAlreadyExists, "Commitment "+intent.ID+" is already revealed")
+	}
+	err = requireUserOrAdmin(stub, intent.User, "revealTradeIntent")
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	// the timestamp identifies the open trade; closeSealedRound keeps it unique
+	trade := AnOpenTrade{"openTrade", intent.User, now, Description{args[1], size1}, Description{args[3], size2}, 0}
+	if intentHash(args[5], trade) != intent.Hash {
+		return errorWithCode(codeInvalidArgument, "The intent does not match commitment "+intent.ID)
+	}
+	intent.Trade = &trade
+	intent.RevealedAt = now
+	err = putSealedIntent(stub, &intent)
+	if err != nil {
+		return errorResponse(err)
+	}
+	fmt.Println("- end revealTradeIntent " + intent.ID)
+	return shim.Success(nil)
+}
+
+// ============================================================
+// uniqueTradeTimestamp - the timestamp, or the next second no open trade uses.
+// Open trades are removed and amended by timestamp, and trades opened or revealed in the same second share one.
+// ============================================================
+func uniqueTradeTimestamp(trades []AnOpenTrade, timestamp int64) int64 {
+	used := map[int64]bool{}
+	for _, trade := range trades {
+		used[trade.Timestamp] = true
+	}
+	for used[timestamp] {
+		timestamp++
+	}
+	return timestamp
+}
+
+// ============================================================
+// closeSealedRound - once the reveal window is over, add the revealed intents to the open trades
+// ============================================================
+func (t *SimpleChaincode) closeSealedRound(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	round, now, err := currentSealedRound(stub)
+	if err != nil {
+		return errorResponse(err)
+	} else if now < round.RevealUntil {
+		return errorWithCode(codeFailedPrecondition, "The reveal window of sealed round "+strconv.Itoa(round.Round)+" is not over")
+	}
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey("sealedIntent", []string{fmt.Sprintf("%010d", round.Round)})
+	if err != nil {
+		return errorResponse(err)
+	}
+	defer resultsIterator.Close()
+
+	tradesAsBytes, err := stub.GetState(openTradesStr)
+	if err != nil {
+		return errorResponse(err)
+	}
+	var trades AllOpenTrades
+	json.Unmarshal(tradesAsBytes, &trades)
+
+	limits, err := getTradeLimits(stub)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	revealed := 0
+	for resultsIterator.HasNext() {
+		responseRange, err := resultsIterator.Next()
+		if err != nil {
+			return errorResponse(err)
+		}
+		intent := sealedIntent{}
+		err = json.Unmarshal(responseRange.Value, &intent)
+		if err != nil {
+			return errorWithCode(codeInternal, "Failed to decode commitment "+responseRange.Key)
+		}
+		if intent.Trade != nil {
+			//revealed intents obey the open trade limits, those that break them are dropped
+			if i := findDuplicateTrade(trades.OpenTrades, *intent.Trade, 0); i >= 0 {
+				fmt.Println("- dropping sealed intent " + intent.ID + ": " + duplicateTradeError(trades.OpenTrades[i]).Error())
+			} else if err = checkOpenTradeLimit(limits, trades.OpenTrades, intent.Trade.User); err != nil {
+				fmt.Println("- dropping sealed intent " + intent.ID + ": " + err.Error())
+			} else {
+				intent.Trade.Timestamp = uniqueTradeTimestamp(trades.OpenTrades, intent.Trade.Timestamp)
+				trades.OpenTrades = append(trades.OpenTrades, *intent.Trade)
+				err = recordTradeActivity(stub, activityTradeOpened, *intent.Trade, "")
+				if err != nil {
+					return errorResponse(err)
+				}
+				revealed++
+			}
+		}
+		err = stub.DelState(responseRange.Key)
+		if err != nil {
+			return errorResponse(err)
+		}
+	}
+
+	tradesAsBytes, err = json.Marshal(trades)
+	if err != nil {
+		return errorResponse(err)
+	}
+	err = stub.PutState(openTradesStr, tradesAsBytes)
+	if err != nil {
+		return errorResponse(err)
+	}
+	round.Closed = true
+	err = putSealedRound(stub, round)
+	if err != nil {
+		return errorResponse(err)
+	}
+	fmt.Printf("- end closeSealedRound %d: %d intents revealed\n", round.Round, revealed)
+	return shim.Success([]byte(strconv.Itoa(revealed)))
+}
@@ -0,0 +1,142 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// ==== Self-trade prevention ====
+// The matchers never settle a cycle made of a single user's trades. A cycle in which a user has
+// several trades, e.g. a triangle tom, jerry, tom, follows the self-trade policy:
+//   exclude  - the cycle is not matched and its trades stay open (default)
+//   collapse - the legs in which the user would give a marble to themselves are dropped,
+//              so tom and jerry swap one marble each and all three trades are filled
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["setSelfTradePolicy","collapse"]}'
+// peer chaincode query -C myc1 -n marbles -c '{"Args":["readSelfTradePolicy"]}'
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+var selfTradeStr = "_selftrade" //name for the key/value that will store the self-trade policy
+
+// what the matchers do with a cycle in which a user has several trades
+const (
+	selfTradeExclude  = "exclude"
+	selfTradeCollapse = "collapse"
+)
+
+type selfTradePolicy struct {
+	Policy string `json:"policy"`
+}
+
+func getSelfTradePolicy(stub shim.ChaincodeStubInterface) (string, error) {
+	policyAsBytes, err := stub.GetState(selfTradeStr)
+	if err != nil {
+		return "", errors.New("Failed to get self-trade policy: " + err.Error())
+	} else if policyAsBytes == nil {
+		return selfTradeExclude, nil
+	}
+	policy := selfTradePolicy{}
+	err = json.Unmarshal(policyAsBytes, &policy)
+	if err != nil {
+		return "", errors.New("Failed to decode self-trade policy: " + err.Error())
+	}
+	return policy.Policy, nil
+}
+
+// ============================================================
+// participants - number of distinct users of the trades
+// ============================================================
+func participants(trades ...AnOpenTrade) int {
+	users := map[string]bool{}
+	for _, trade := range trades {
+		users[trade.User] = true
+	}
+	return len(users)
+}
+
+// ============================================================
+// selfTradeAllowed - whether the policy lets the matchers settle a cycle of these trades
+// ============================================================
+func selfTradeAllowed(policy string, trades ...AnOpenTrade) bool {
+	users := participants(trades...)
+	if users == len(trades) {
+		return true
+	}
+	return policy == selfTradeCollapse && users > 1
+}
+
+// ============================================================
+// collapseLegs - drop the legs whose marble would go to its own owner.
+// Each leg gives to the owner of the next one, and a dropped leg has the same owner as the next,
+// so every remaining marble still goes to the user it went to before.
+// ============================================================
+func collapseLegs(legs []swapLeg) []swapLeg {
+	collapsed := []swapLeg{}
+	for i, leg := range legs {
+		if leg.Owner != legs[(i+1)%len(legs)].Owner {
+			collapsed = append(collapsed, leg)
+		}
+	}
+	return collapsed
+}
+
+// ============================================================
+// setSelfTradePolicy - set what the matchers do with cycles in which a user has several trades (admin)
+// ============================================================
+func (t *SimpleChaincode) setSelfTradePolicy(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0
+	// "collapse"
+	if len(args) != 1 {
+		return errorWithCode(codeInvalidArgument, "Incorrect number of arguments. Expecting exclude or collapse")
+	}
+	if args[0] != selfTradeExclude && args[0] != selfTradeCollapse {
+		return errorWithCode(codeInvalidArgument, "1st argument must be exclude or collapse")
+	}
+	policyAsBytes, err := json.Marshal(selfTradePolicy{args[0]})
+	if err != nil {
+		return errorResponse(err)
+	}
+	err = stub.PutState(selfTradeStr, policyAsBytes)
+	if err != nil {
+		return errorResponse(err)
+	}
+	fmt.Println("- end setSelfTradePolicy " + args[0])
+	return shim.Success(policyAsBytes)
+}
+
+// ============================================================
+// readSelfTradePolicy - read the self-trade policy
+// ============================================================
+func (t *SimpleChaincode) readSelfTradePolicy(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	policy, err := getSelfTradePolicy(stub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	policyAsBytes, err := json.Marshal(selfTradePolicy{policy})
+	if err != nil {
+		return errorResponse(err)
+	}
+	return shim.Success(policyAsBytes)
+}
@@ -0,0 +1,98 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func testTrade(user string, want string, willing string) AnOpenTrade {
+	return AnOpenTrade{"openTrade", user, 0, Description{want, 50}, Description{willing, 50}, 0}
+}
+
+// receivers - who gets the marble of each leg, by giver and color
+func receivers(legs []swapLeg) map[string]string {
+	to := map[string]string{}
+	for i, leg := range legs {
+		to[leg.Owner+"/"+leg.Color] = legs[(i+1)%len(legs)].Owner
+	}
+	return to
+}
+
+func TestSelfTradeAllowed(t *testing.T) {
+	cases := []struct {
+		name     string
+		trades   []AnOpenTrade
+		exclude  bool
+		collapse bool
+	}{
+		{"pair of two users", []AnOpenTrade{testTrade("tom", "red", "blue"), testTrade("jerry", "blue", "red")}, true, true},
+		{"pair of one user", []AnOpenTrade{testTrade("tom", "red", "blue"), testTrade("tom", "blue", "red")}, false, false},
+		{"triangle of three users", []AnOpenTrade{testTrade("tom", "red", "blue"), testTrade("jerry", "green", "red"), testTrade("alice", "blue", "green")}, true, true},
+		{"triangle of two users", []AnOpenTrade{testTrade("tom", "red", "blue"), testTrade("jerry", "green", "red"), testTrade("tom", "blue", "green")}, false, true},
+		{"triangle of one user", []AnOpenTrade{testTrade("tom", "red", "blue"), testTrade("tom", "green", "red"), testTrade("tom", "blue", "green")}, false, false},
+	}
+	for _, c := range cases {
+		if got := selfTradeAllowed(selfTradeExclude, c.trades...); got != c.exclude {
+			t.Errorf("%s: exclude allowed %v, want %v", c.name, got, c.exclude)
+		}
+		if got := selfTradeAllowed(selfTradeCollapse, c.trades...); got != c.collapse {
+			t.Errorf("%s: collapse allowed %v, want %v", c.name, got, c.collapse)
+		}
+	}
+}
+
+func TestCollapseLegs(t *testing.T) {
+	cases := []struct {
+		name string
+		legs []swapLeg
+		want []swapLeg
+	}{
+		{"distinct users are kept",
+			[]swapLeg{{"tom", "blue", 50}, {"alice", "green", 50}, {"jerry", "red", 50}},
+			[]swapLeg{{"tom", "blue", 50}, {"alice", "green", 50}, {"jerry", "red", 50}}},
+		{"user around the end of the cycle",
+			[]swapLeg{{"tom", "blue", 50}, {"jerry", "red", 50}, {"tom", "green", 50}},
+			[]swapLeg{{"tom", "blue", 50}, {"jerry", "red", 50}}},
+		{"user with consecutive legs",
+			[]swapLeg{{"tom", "blue", 50}, {"tom", "green", 50}, {"jerry", "red", 50}},
+			[]swapLeg{{"tom", "green", 50}, {"jerry", "red", 50}}},
+		{"single user",
+			[]swapLeg{{"tom", "blue", 50}, {"tom", "red", 50}},
+			[]swapLeg{}},
+		{"user apart in a longer cycle",
+			[]swapLeg{{"tom", "blue", 50}, {"jerry", "red", 50}, {"tom", "green", 50}, {"alice", "white", 50}},
+			[]swapLeg{{"tom", "blue", 50}, {"jerry", "red", 50}, {"tom", "green", 50}, {"alice", "white", 50}}},
+	}
+	for _, c := range cases {
+		got := collapseLegs(c.legs)
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: collapsed to %v, want %v", c.name, got, c.want)
+			continue
+		}
+		before := receivers(c.legs)
+		for giver, to := range receivers(got) {
+			if before[giver] != to {
+				t.Errorf("%s: %s goes to %s after collapsing, %s before", c.name, giver, to, before[giver])
+			}
+		}
+	}
+}
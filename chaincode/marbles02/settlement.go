@@ -0,0 +1,301 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// ==== Settlements ====
+// Every swap, whether called directly or by a matcher, is recorded as a settlement: the open trades
+// it filled and one leg per marble that changed owner. A settled marble carries the settlement ID,
+// so its history tells which settlement moved it.
+// peer chaincode query -C myc1 -n marbles -c '{"Args":["readSettlement","<txid>-0"]}'
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// settlement kinds
+const (
+	settlementSwap     = "swap"     //swapMarble or swapMarbleTri called directly
+	settlementPair     = "pair"     //two open trades matched
+	settlementTriangle = "triangle" //three open trades matched in a cycle
+)
+
+// swapLeg is what one participant gives away: a marble of this color
+type swapLeg struct {
+	Owner string
+	Color string
+	Size  int
+}
+
+type settlementLeg struct {
+	Marble string `json:"marble"`
+	Color  string `json:"color"`
+	Size   int    `json:"size"`
+	From   string `json:"from"`
+	To     string `json:"to"`
+}
+
+type settlement struct {
+	ObjectType  string          `json:"docType"`
+	ID          string          `json:"id"` //<txid>-<sequence in the transaction>
+	TxID        string          `json:"txId"`
+	Timestamp   int64           `json:"timestamp"`
+	Kind        string          `json:"kind"`
+	Trades      []AnOpenTrade   `json:"trades,omitempty"` //the open trades filled by this settlement
+	Legs        []settlementLeg `json:"legs"`
+	Credits     []creditLeg     `json:"credits,omitempty"`     //credits moved with the marbles
+	FeeSchedule int             `json:"feeSchedule,omitempty"` //version of the fee schedule charged
+	Fees        []feeCharge     `json:"fees,omitempty"`
+}
+
+func getSettlement(stub shim.ChaincodeStubInterface, id string) (*settlement, error) {
+	settlementKey, err := stub.CreateCompositeKey("settlement", []string{id})
+	if err != nil {
+		return nil, err
+	}
+	settlementAsBytes, err := stub.GetState(settlementKey)
+	if err != nil {
+		return nil, errors.New("Failed to get settlement: " + err.Error())
+	} else if settlementAsBytes == nil {
+		return nil, nil
+	}
+	s := settlement{}
+	err = json.Unmarshal(settlementAsBytes, &s)
+	if err != nil {
+		return nil, errors.New("Failed to decode settlement " + id + ": " + err.Error())
+	}
+	return &s, nil
+}
+
+func putSettlement(stub shim.ChaincodeStubInterface, s *settlement) error {
+	settlementKey, err := stub.CreateCompositeKey("settlement", []string{s.ID})
+	if err != nil {
+		return err
+	}
+	settlementAsBytes, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(settlementKey, settlementAsBytes)
+}
+
+// settlementRun holds the balances changed by the settlements of one transaction.
+// Reads do not see the writes of the transaction they are in, so a second settlement
+// in the same match run must start from these instead of from state.
+type settlementRun struct {
+	credits     map[string]*creditBalance
+	fees        map[string]*feeBalance
+	reputations map[string]*reputation
+	shortOf     string                         //user without the marble to give when the last settlement was not made
+	inventory   map[string]map[string][]string //tradable marbles of each color by owner at the start of the run
+	given       map[string]bool                //marbles given by the settlements of the run
+}
+
+func newSettlementRun() *settlementRun {
+	return &settlementRun{map[string]*creditBalance{}, map[string]*feeBalance{}, map[string]*reputation{}, "",
+		map[string]map[string][]string{}, map[string]bool{}}
+}
+
+// creditBalance - a copy of the credit balance of a user as of this run
+func (run *settlementRun) creditBalance(stub shim.ChaincodeStubInterface, user string) (*creditBalance, error) {
+	if balance, ok := run.credits[user]; ok {
+		copied := *balance
+		return &copied, nil
+	}
+	return getCreditBalance(stub, user)
+}
+
+// feeBalance - a copy of the fee balance of a user as of this run
+func (run *settlementRun) feeBalance(stub shim.ChaincodeStubInterface, user string) (*feeBalance, error) {
+	if balance, ok := run.fees[user]; ok {
+		copied := *balance
+		return &copied, nil
+	}
+	return getFeeBalance(stub, user)
+}
+
+// ============================================================
+// settleSwap - each leg's marble goes to the owner of the next leg, the last one to the first,
+// and the credits of the trades move with them.
+// Returns nil without writing anything if a participant has no marble to give.
+// Every transfer is checked before the first write.
+// ============================================================
+func settleSwap(stub shim.ChaincodeStubInterface, run *settlementRun, kind string, sequence int, legs []swapLeg, trades []AnOpenTrade) (*settlement, error) {
+	timestamp, err := txTimestamp(stub)
+	if err != nil {
+		return nil, err
+	}
+	s := &settlement{ObjectType: "settlement", ID: stub.GetTxID() + "-" + strconv.Itoa(sequence), TxID: stub.GetTxID(),
+		Timestamp: timestamp, Kind: kind, Trades: trades, Legs: []settlementLeg{}}
+
+	run.shortOf = ""
+	marbleNames, short, err := run.pickMarbles(stub, legs, false)
+	if err != nil {
+		return nil, err
+	}
+	if short >= 0 {
+		fmt.Println("- settleSwap: no " + legs[short].Color + " marble for " + legs[short].Owner)
+		run.shortOf = legs[short].Owner
+		return nil, nil
+	}
+	transfers := []*marble{}
+	for i, leg := range legs {
+		marbleName := marbleNames[i]
+		to := legs[(i+1)%len(legs)].Owner
+		transferred, _, err := prepareTransfer(stub, marbleName, to)
+		if err != nil {
+			return nil, err
+		}
+		transferred.Settlement = s.ID
+		transfers = append(transfers, transferred)
+		s.Legs = append(s.Legs, settlementLeg{marbleName, transferred.Color, transferred.Size, leg.Owner, to})
+	}
+	creditLegs, balances, err := prepareCreditLegs(stub, run, trades)
+	if err != nil {
+		return nil, err
+	}
+	if len(creditLegs) > 0 {
+		s.Credits = creditLegs
+	}
+	var feeBalances []*feeBalance
+	if kind != settlementSwap {
+		// only matched trades pay fees
+		var schedule *feeSchedule
+		schedule, s.Fees, feeBalances, balances, err = prepareFees(stub, run, legs, balances)
+		if err != nil {
+			return nil, err
+		}
+		if schedule != nil {
+			s.FeeSchedule = schedule.Version
+		}
+	}
+
+	for i, transferred := range transfers {
+		err = putMarble(stub, transferred)
+		if err != nil {
+			return nil, err
+		}
+		err = recordTransfer(stub, transferred, s.Legs[i].From)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, balance := range balances {
+		err = putCreditBalance(stub, balance)
+		if err != nil {
+			return nil, err
+		}
+		run.credits[balance.User] = balance
+	}
+	for _, balance := range feeBalances {
+		err = putFeeBalance(stub, balance)
+		if err != nil {
+			return nil, err
+		}
+		run.fees[balance.User] = balance
+	}
+	err = putSettlement(stub, s)
+	if err != nil {
+		return nil, err
+	}
+	for _, marbleName := range marbleNames {
+		run.given[marbleName] = true
+	}
+	fmt.Println("- settleSwap: settled " + s.ID)
+	return s, nil
+}
+
+// ============================================================
+// parseSwapLegs - owner, color, size triples of swapMarble and swapMarbleTri
+// ============================================================
+func parseSwapLegs(args []string) ([]swapLeg, error) {
+	legs := []swapLeg{}
+	for i := 0; i+2 < len(args); i += 3 {
+		size, err := strconv.Atoi(args[i+2])
+		if err != nil {
+			return nil, newError(codeInvalidArgument, "Argument "+strconv.Itoa(i+3)+" must be a numeric string")
+		}
+		legs = append(legs, swapLeg{args[i], args[i+1], size})
+	}
+	return legs, nil
+}
+
+// ============================================================
+// readSettlement - read a settlement
+// ============================================================
+func (t *SimpleChaincode) readSettlement(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return errorWithCode(codeInvalidArgument, "Incorrect number of arguments. Expecting settlement ID")
+	}
+	s, err := getSettlement(stub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	} else if s == nil {
+		return errorWithCode(codeNotFound, "Settlement does not exist: "+args[0])
+	}
+	settlementAsBytes, err := json.Marshal(s)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return shim.Success(settlementAsBytes)
+}
+
+// ============================================================
+// matchLegs - the legs of matched open trades, each trade giving what it is willing to trade to the next one.
+// A user with consecutive trades in the cycle does not give a marble to themselves.
+// ============================================================
+func matchLegs(trades []AnOpenTrade) []swapLeg {
+	legs := make([]swapLeg, len(trades))
+	for i, trade := range trades {
+		legs[i] = swapLeg{trade.User, trade.Willing.Color, trade.Willing.Size}
+	}
+	return collapseLegs(legs)
+}
+
+// ============================================================
+// settleMatch - settle matched open trades along their matchLegs.
+// A match that cannot be settled, e.g. a user no longer registered, is logged and skipped;
+// only state database errors abort the run.
+// ============================================================
+func settleMatch(stub shim.ChaincodeStubInterface, run *settlementRun, kind string, sequence int, trades []AnOpenTrade) (*settlement, error) {
+	s, err := settleSwap(stub, run, kind, sequence, matchLegs(trades), trades)
+	if err != nil && errorCode(err) != codeInternal {
+		fmt.Println("- settleMatch: skipped, " + err.Error())
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = recordMatchOutcome(stub, run, s, trades)
+	if err != nil || s == nil {
+		return nil, err
+	}
+	for _, trade := range trades {
+		err = recordTradeActivity(stub, activityTradeFilled, trade, s.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
@@ -0,0 +1,140 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// ==== Ownership timeline ====
+// The history of a marble folded into ownership periods: who held it, from when until when,
+// and the transaction, and settlement if any, that started and ended each period.
+// The last period has no releasedAt while the marble is still held.
+// peer chaincode query -C myc1 -n marbles -c '{"Args":["getOwnershipTimeline","marble1"]}'
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// how an owner acquired or released a marble
+const (
+	ownershipMinted     = "mint"
+	ownershipTransfer   = "transfer"
+	ownershipSettlement = "settlement"
+	ownershipBurned     = "burn"
+	ownershipDeleted    = "delete"
+)
+
+type ownershipPeriod struct {
+	Owner              string `json:"owner"`
+	AcquiredAt         string `json:"acquiredAt"` //RFC3339
+	AcquiredTxID       string `json:"acquiredTxId"`
+	AcquiredBy         string `json:"acquiredBy"` //mint, transfer or settlement
+	AcquiredSettlement string `json:"acquiredSettlement,omitempty"`
+	ReleasedAt         string `json:"releasedAt,omitempty"`
+	ReleasedTxID       string `json:"releasedTxId,omitempty"`
+	ReleasedBy         string `json:"releasedBy,omitempty"` //transfer, settlement, burn or delete
+	ReleasedSettlement string `json:"releasedSettlement,omitempty"`
+}
+
+type ownershipTimeline struct {
+	Marble  string            `json:"marble"`
+	Periods []ownershipPeriod `json:"periods"`
+}
+
+// ============================================================
+// getOwnershipTimeline - ownership periods of a marble, oldest first
+// ============================================================
+func (t *SimpleChaincode) getOwnershipTimeline(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return errorWithCode(codeInvalidArgument, "Incorrect number of arguments. Expecting name of the marble")
+	}
+	marbleName := args[0]
+	fmt.Printf("- start getOwnershipTimeline: %s\n", marbleName)
+
+	resultsIterator, err := stub.GetHistoryForKey(marbleName)
+	if err != nil {
+		return errorResponse(err)
+	}
+	defer resultsIterator.Close()
+
+	timeline := ownershipTimeline{marbleName, []ownershipPeriod{}}
+	var current *ownershipPeriod //period of the owner holding the marble, nil before the mint and after a delete
+	release := func(at string, txID string, by string, settlementID string) {
+		current.ReleasedAt, current.ReleasedTxID, current.ReleasedBy, current.ReleasedSettlement = at, txID, by, settlementID
+		timeline.Periods = append(timeline.Periods, *current)
+		current = nil
+	}
+	for resultsIterator.HasNext() {
+		modification, err := resultsIterator.Next()
+		if err != nil {
+			return errorResponse(err)
+		}
+		at := ""
+		if modification.Timestamp != nil {
+			at = time.Unix(modification.Timestamp.Seconds, int64(modification.Timestamp.Nanos)).UTC().Format(time.RFC3339)
+		}
+
+		if modification.IsDelete {
+			if current != nil {
+				release(at, modification.TxId, ownershipDeleted, "")
+			}
+			continue
+		}
+		m := marble{}
+		err = json.Unmarshal(modification.Value, &m)
+		if err != nil {
+			return errorWithCode(codeInternal, "Failed to decode JSON of "+marbleName+" in transaction "+modification.TxId)
+		}
+		upgradeMarble(&m)
+
+		if m.Status == marbleStatusBurned {
+			if current != nil {
+				release(at, modification.TxId, ownershipBurned, "")
+			}
+			continue
+		}
+		if current != nil && current.Owner == m.Owner {
+			continue //updated, locked or unlocked by the same owner
+		}
+
+		acquiredBy := ownershipTransfer
+		if m.Settlement != "" {
+			acquiredBy = ownershipSettlement
+		}
+		if current != nil {
+			release(at, modification.TxId, acquiredBy, m.Settlement)
+		} else {
+			acquiredBy = ownershipMinted
+		}
+		current = &ownershipPeriod{Owner: m.Owner, AcquiredAt: at, AcquiredTxID: modification.TxId, AcquiredBy: acquiredBy, AcquiredSettlement: m.Settlement}
+	}
+	if current != nil {
+		timeline.Periods = append(timeline.Periods, *current)
+	}
+
+	timelineAsBytes, err := json.Marshal(timeline)
+	if err != nil {
+		return errorResponse(err)
+	}
+	fmt.Printf("- end getOwnershipTimeline: %d periods\n", len(timeline.Periods))
+	return shim.Success(timelineAsBytes)
+}
@@ -0,0 +1,191 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// ==== Marble updates ====
+// Change the color, size or attributes of an active marble in place, so its history is kept.
+// The changes are a JSON object with any of "color", "size" and "attributes"; attributes replace
+// the current ones and are validated against the latest marble schema. A reason is required and
+// is recorded on the marble with who made the change, so getHistoryForMarble shows every update.
+// Updates are made by the custodian who attested the marble or by an admin.
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["updateMarble","marble1","{\"color\":\"red\",\"size\":40}","repainted at vault 3"]}'
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+type marbleUpdate struct {
+	Changed   []string `json:"changed"` //names of the changed properties
+	Reason    string   `json:"reason"`
+	MSPID     string   `json:"mspid"`
+	By        string   `json:"by"` //enrolled identity of the caller
+	TxID      string   `json:"txId"`
+	Timestamp int64    `json:"timestamp"`
+}
+
+// ============================================================
+// reindexMarble - move the index entries of a marble after its indexed properties changed
+// ============================================================
+func reindexMarble(stub shim.ChaincodeStubInterface, previous *marble, updated *marble) error {
+	if previous.Color != updated.Color {
+		err := delColorIndex(stub, previous)
+		if err != nil {
+			return err
+		}
+		err = putColorIndex(stub, updated)
+		if err != nil {
+			return err
+		}
+	}
+	// tag~name is keyed by the tag hash, which cannot change once bound
+	return nil
+}
+
+// ============================================================
+// applyMarbleChanges - validate a JSON object of changes and apply it to a marble
+// ============================================================
+func applyMarbleChanges(stub shim.ChaincodeStubInterface, m *marble, changesJSON string) ([]string, error) {
+	changes := map[string]json.RawMessage{}
+	err := json.Unmarshal([]byte(changesJSON), &changes)
+	if err != nil {
+		return nil, newError(codeInvalidArgument, "2nd argument must be a JSON object of changes: "+err.Error())
+	}
+	if len(changes) == 0 {
+		return nil, newError(codeInvalidArgument, "No change given")
+	}
+
+	changed := []string{}
+	for property, value := range changes {
+		switch property {
+		case "color":
+			var color string
+			if json.Unmarshal(value, &color) != nil || color == "" {
+				return nil, newError(codeInvalidArgument, "color must be a non-empty string")
+			}
+			m.Color = strings.ToLower(color)
+		case "size":
+			var size int
+			if json.Unmarshal(value, &size) != nil {
+				return nil, newError(codeInvalidArgument, "size must be an integer")
+			}
+			m.Size = size
+		case "attributes":
+			var attributes map[string]interface{}
+			if json.Unmarshal(value, &attributes) != nil {
+				return nil, newError(codeInvalidArgument, "attributes must be a JSON object")
+			}
+			schema, err := getSchema(stub, "marble", 0)
+			if err != nil {
+				return nil, err
+			}
+			err = validateAttributes(schema, attributes)
+			if err != nil {
+				return nil, err
+			}
+			m.Attributes = attributes
+			m.AttributesSchema = 0
+			if len(attributes) > 0 {
+				m.AttributesSchema = schema.Version
+			}
+		default:
+			return nil, newError(codeInvalidArgument, fmt.Sprintf("Property %q cannot be updated, expecting color, size or attributes", property))
+		}
+		changed = append(changed, property)
+	}
+	sort.Strings(changed)
+	return changed, nil
+}
+
+// ============================================================
+// updateMarble - change the properties of a marble, keeping its indexes consistent
+// ============================================================
+func (t *SimpleChaincode) updateMarble(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0          1                  2
+	// "marble1", "{\"size\":40}", "remeasured"
+	if len(args) != 3 {
+		return errorWithCode(codeInvalidArgument, "Incorrect number of arguments. Expecting 3")
+	}
+	marbleName := args[0]
+	reason := strings.TrimSpace(args[2])
+	if reason == "" {
+		return errorWithCode(codeInvalidArgument, "3rd argument must be the reason of the change")
+	}
+	fmt.Println("- start updateMarble ", marbleName)
+
+	previous, err := getMarble(stub, marbleName)
+	if err != nil {
+		return errorResponse(err)
+	} else if previous == nil {
+		return errorWithCode(codeNotFound, "Marble does not exist: "+marbleName)
+	} else if previous.Status != marbleStatusActive {
+		return errorWithCode(codeFailedPrecondition, "Marble "+marbleName+" cannot be updated, status: "+previous.Status)
+	}
+
+	// ==== Only the custodian who vouched for the marble, or an admin, can change it ====
+	attested := false
+	if previous.Attestation != nil {
+		attested, err = callerIsUser(stub, previous.Attestation.Custodian)
+		if err != nil {
+			return errorResponse(err)
+		}
+	}
+	if !attested {
+		err = requireAdmin(stub, "updateMarble by anyone but the attesting custodian")
+		if err != nil {
+			return errorResponse(err)
+		}
+	}
+
+	updated := *previous
+	changed, err := applyMarbleChanges(stub, &updated, args[1])
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	// ==== Record who changed what and why ====
+	mspid, id, err := getCallerIdentity(stub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	timestamp, err := txTimestamp(stub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	updated.LastUpdate = &marbleUpdate{changed, reason, mspid, id, stub.GetTxID(), timestamp}
+
+	err = putMarble(stub, &updated)
+	if err != nil {
+		return errorResponse(err)
+	}
+	err = reindexMarble(stub, previous, &updated)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	fmt.Println("- end updateMarble (success)", changed)
+	return shim.Success(nil)
+}
@@ -0,0 +1,264 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// ==== User registry ====
+// Register the calling identity under a handle:
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["registerUser","tom"]}'
+// An admin can bind a handle to another enrolled identity (identity as returned by cid.GetID):
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["registerUser","jerry","Org2MSP","eDUwOTo6Q049..."]}'
+// peer chaincode query -C myc1 -n marbles -c '{"Args":["readUser","tom"]}'
+// peer chaincode query -C myc1 -n marbles -c '{"Args":["listUsers"]}'
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+type user struct {
+	ObjectType string `json:"docType"` //docType is used to distinguish the various types of objects in state database
+	Handle     string `json:"handle"`
+	MSPID      string `json:"mspid"`
+	Identity   string `json:"identity"`            //enrolled certificate identity, as returned by cid.GetID
+	Registered int64  `json:"registered"`          //transaction timestamp of the registration
+	Custodian  bool   `json:"custodian,omitempty"` //custodians vouch for physical objects, see approveMint
+}
+
+// handles end up in rich query selectors, so keep them to a safe character set
+var validHandle = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]*$`)
+
+// ============================================================
+// getCallerIdentity - MSP ID and enrolled identity of the transaction creator
+// ============================================================
+func getCallerIdentity(stub shim.ChaincodeStubInterface) (string, string, error) {
+	mspid, err := cid.GetMSPID(stub)
+	if err != nil {
+		return "", "", errors.New("Failed to get caller MSP ID: " + err.Error())
+	}
+	id, err := cid.GetID(stub)
+	if err != nil {
+		return "", "", errors.New("Failed to get caller identity: " + err.Error())
+	}
+	return mspid, id, nil
+}
+
+// ============================================================
+// getUser - read a user from chaincode state, nil if the handle is not registered
+// ============================================================
+func getUser(stub shim.ChaincodeStubInterface, handle string) (*user, error) {
+	userKey, err := stub.CreateCompositeKey("user", []string{handle})
+	if err != nil {
+		return nil, err
+	}
+	userAsBytes, err := stub.GetState(userKey)
+	if err != nil {
+		return nil, errors.New("Failed to get user: " + err.Error())
+	} else if userAsBytes == nil {
+		return nil, nil
+	}
+
+	registered := user{}
+	err = json.Unmarshal(userAsBytes, &registered)
+	if err != nil {
+		return nil, errors.New("Failed to decode user " + handle + ": " + err.Error())
+	}
+	return &registered, nil
+}
+
+func putUser(stub shim.ChaincodeStubInterface, u *user) error {
+	userJSONasBytes, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	userKey, err := stub.CreateCompositeKey("user", []string{u.Handle})
+	if err != nil {
+		return err
+	}
+	return stub.PutState(userKey, userJSONasBytes)
+}
+
+// ============================================================
+// requireUser - return an error unless the handle is registered
+// ============================================================
+func requireUser(stub shim.ChaincodeStubInterface, handle string) error {
+	registered, err := getUser(stub, handle)
+	if err != nil {
+		return err
+	}
+	if registered == nil {
+		return newError(codeNotFound, "Unknown user: "+handle)
+	}
+	return nil
+}
+
+// ============================================================
+// callerIsUser - check whether the transaction creator is the identity registered under handle
+// ============================================================
+func callerIsUser(stub shim.ChaincodeStubInterface, handle string) (bool, error) {
+	registered, err := getUser(stub, handle)
+	if err != nil {
+		return false, err
+	}
+	if registered == nil {
+		return false, nil
+	}
+	mspid, id, err := getCallerIdentity(stub)
+	if err != nil {
+		return false, err
+	}
+	return registered.MSPID == mspid && registered.Identity == id, nil
+}
+
+// ============================================================
+// requireUserOrAdmin - return an error unless the caller is the user registered under handle or an admin
+// ============================================================
+func requireUserOrAdmin(stub shim.ChaincodeStubInterface, handle string, function string) error {
+	self, err := callerIsUser(stub, handle)
+	if err != nil {
+		return err
+	}
+	if self {
+		return nil
+	}
+	admin, err := isAdmin(stub)
+	if err != nil {
+		return err
+	}
+	if !admin {
+		return newError(codeForbidden, function+" is restricted to "+handle+" or an admin")
+	}
+	return nil
+}
+
+// ============================================================
+// registerUser - bind a user handle to an enrolled identity
+// ============================================================
+func (t *SimpleChaincode) registerUser(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0       1          2
+	// "bob", ["Org1MSP", "eDUwOTo6..."]
+	if len(args) != 1 && len(args) != 3 {
+		return errorWithCode(codeInvalidArgument, "Incorrect number of arguments. Expecting 1 or 3")
+	}
+
+	handle := strings.ToLower(args[0])
+	if !validHandle.MatchString(handle) {
+		return errorWithCode(codeInvalidArgument, "1st argument must be a handle of letters, digits, '.', '_' or '-'")
+	}
+
+	mspid, id, err := getCallerIdentity(stub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if len(args) == 3 {
+		// binding a handle to someone else's identity is an admin operation
+		err = requireAdmin(stub, "registerUser for another identity")
+		if err != nil {
+			return errorResponse(err)
+		}
+		if len(args[1]) <= 0 || len(args[2]) <= 0 {
+			return errorWithCode(codeInvalidArgument, "MSP ID and identity must be non-empty strings")
+		}
+		mspid = args[1]
+		id = args[2]
+	}
+
+	// ==== Check if user already exists ====
+	existing, err := getUser(stub, handle)
+	if err != nil {
+		return errorResponse(err)
+	} else if existing != nil {
+		return errorWithCode(codeAlreadyExists, "This user already exists: "+handle)
+	}
+
+	registered, err := txTimestamp(stub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	newUser := &user{"user", handle, mspid, id, registered, false}
+	err = putUser(stub, newUser)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	fmt.Println("- end registerUser " + handle)
+	return shim.Success(nil)
+}
+
+// ============================================================
+// readUser - read a registered user
+// ============================================================
+func (t *SimpleChaincode) readUser(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return errorWithCode(codeInvalidArgument, "Incorrect number of arguments. Expecting handle of the user to query")
+	}
+
+	handle := strings.ToLower(args[0])
+	registered, err := getUser(stub, handle)
+	if err != nil {
+		return errorResponse(err)
+	} else if registered == nil {
+		return errorWithCode(codeNotFound, "User does not exist: "+handle)
+	}
+
+	userAsBytes, err := json.Marshal(registered)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return shim.Success(userAsBytes)
+}
+
+// ============================================================
+// listUsers - list every registered user
+// ============================================================
+func (t *SimpleChaincode) listUsers(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey("user", []string{})
+	if err != nil {
+		return errorResponse(err)
+	}
+	defer resultsIterator.Close()
+
+	users := []user{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return errorResponse(err)
+		}
+		registered := user{}
+		err = json.Unmarshal(queryResponse.Value, &registered)
+		if err != nil {
+			return errorResponse(err)
+		}
+		users = append(users, registered)
+	}
+
+	usersAsBytes, err := json.Marshal(users)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return shim.Success(usersAsBytes)
+}
@@ -182,7 +182,7 @@ export class CreateComponent implements OnInit {
     }
     
     this.getRequest(baseUrl, params).subscribe((data) => {
-      this.assetsStates[owner] = data 
+      this.assetsStates[owner] = data["data"]
       console.log(data)
       return this.updateTable()
     });
@@ -144,7 +144,7 @@ export class TradeComponent implements OnInit {
     }
     
     this.getRequest(baseUrl, params).subscribe((data) => {
-      this.openTradesStates = data["open_trades"] 
+      this.openTradesStates = data["data"]["open_trades"] // chaincode responses are wrapped in {status, code, message, data} 
       console.log(data)
       return this.updateTable()
     });
@@ -0,0 +1,128 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// ==== Provenance verifier ====
+// Recompute the hash chain of a marble history exported with the getProvenance query and flag
+// every record whose hash does not match. The file may hold the query result or the full response
+// envelope. Pass -digest with the digest of a fresh query to check the export against the ledger.
+// The chain is computed by the chaincode's provenance package, so build with the chaincode on the
+// GOPATH at github.com/marbles02, where the peer installs it.
+// peer chaincode query -C myc1 -n marbles -c '{"Args":["getProvenance","marble1"]}' > marble1.json
+// GO111MODULE=off go run ./tools/verifyProvenance -digest 3f1c...e9 marble1.json
+//
+// Exit status: 0 when the chain verifies, 1 on a mismatch, 2 when the file cannot be read.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/marbles02/provenance"
+)
+
+// readProvenance - decode an exported query result, unwrapping the response envelope if present
+func readProvenance(path string) (*provenance.Provenance, error) {
+	var content []byte
+	var err error
+	if path == "-" {
+		content, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		content, err = ioutil.ReadFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	envelope := struct {
+		Data json.RawMessage `json:"data"`
+	}{}
+	err = json.Unmarshal(content, &envelope)
+	if err != nil {
+		return nil, err
+	}
+	if len(envelope.Data) > 0 {
+		content = envelope.Data
+	}
+	p := provenance.Provenance{}
+	err = json.Unmarshal(content, &p)
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// verify - recompute the chain and return one line per problem found
+func verify(p *provenance.Provenance, expectedDigest string) []string {
+	problems := []string{}
+	if p.Algorithm != provenance.Algorithm {
+		return append(problems, fmt.Sprintf("unknown algorithm %q, expecting %q", p.Algorithm, provenance.Algorithm))
+	}
+	if len(p.Records) == 0 {
+		return append(problems, "no history records")
+	}
+	previous := ""
+	for i, r := range p.Records {
+		hash, err := provenance.ChainHash(p.Marble, previous, r)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("record %d (tx %s): value is not JSON: %s", i, r.TxID, err))
+			hash = r.Hash //carry on with the exported hash to check the rest of the chain
+		} else if hash != r.Hash {
+			problems = append(problems, fmt.Sprintf("record %d (tx %s): hash mismatch, exported %s, computed %s", i, r.TxID, r.Hash, hash))
+		}
+		previous = hash
+	}
+	if previous != p.Digest {
+		problems = append(problems, fmt.Sprintf("digest mismatch, exported %s, computed %s", p.Digest, previous))
+	}
+	if expectedDigest != "" && previous != expectedDigest {
+		problems = append(problems, fmt.Sprintf("digest %s does not match the expected digest %s", previous, expectedDigest))
+	}
+	return problems
+}
+
+func main() {
+	expectedDigest := flag.String("digest", "", "digest from a fresh getProvenance query to compare with")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: verifyProvenance [-digest <hex>] <exported file | ->")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	p, err := readProvenance(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to read provenance: "+err.Error())
+		os.Exit(2)
+	}
+	problems := verify(p, *expectedDigest)
+	for _, problem := range problems {
+		fmt.Println("MISMATCH " + problem)
+	}
+	if len(problems) > 0 {
+		fmt.Printf("%s: %d problems in %d records\n", p.Marble, len(problems), len(p.Records))
+		os.Exit(1)
+	}
+	fmt.Printf("%s: %d records verified, digest %s\n", p.Marble, len(p.Records), p.Digest)
+}